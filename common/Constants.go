@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // 目录相关常量
 const (
 	// 任务保存目录
@@ -13,6 +15,39 @@ const (
 
 	// 服务注册目录
 	JOB_WORKER_DIR = "/cron/workers/"
+
+	// 任务最近一次成功执行的计划时间
+	JOB_WATERMARK_DIR = "/cron/watermark/"
+
+	// 手动触发任务目录
+	JOB_TRIGGER_DIR = "/cron/trigger/"
+
+	// 手动触发请求的状态目录 /cron/trigger_status/触发ID
+	JOB_TRIGGER_STATUS_DIR = "/cron/trigger_status/"
+
+	// 强杀确认目录
+	JOB_KILLACK_DIR = "/cron/killack/"
+
+	// 正在执行的任务目录
+	JOB_RUNNING_DIR = "/cron/running/"
+
+	// 工作流保存目录
+	WORKFLOW_SAVE_DIR = "/cron/workflows/"
+
+	// 工作流运行记录目录
+	WORKFLOW_RUN_DIR = "/cron/workflow_runs/"
+
+	// 调度leader选举的key
+	JOB_LEADER_KEY = "/cron/leader"
+
+	// leader分派给worker的执行目录 /cron/assign/ip/执行ID
+	JOB_ASSIGN_DIR = "/cron/assign/"
+
+	// worker拒绝后交还leader重新分派的执行 /cron/assign_return/执行ID
+	JOB_ASSIGN_RETURN_DIR = "/cron/assign_return/"
+
+	// worker下线请求目录 /cron/drain/ip
+	JOB_DRAIN_DIR = "/cron/drain/"
 )
 
 // 任务事件常量
@@ -20,4 +55,283 @@ const (
 	JOB_EVENT_SAVE   int = iota // 保存任务事件
 	JOB_EVENT_DELETE            // 删除任务事件
 	JOB_EVENT_KILLER
+	JOB_EVENT_TRIGGER         // 手动触发任务事件
+	JOB_EVENT_WORKFLOW_SAVE   // 保存工作流事件
+	JOB_EVENT_WORKFLOW_DELETE // 删除工作流事件
+	JOB_EVENT_ASSIGN          // leader分派执行事件
+	JOB_EVENT_KILL_ALL        // worker下线超时，强杀所有执行事件
+	JOB_EVENT_WATERMARK       // 水位线推进事件，leader按它分派下一个补执行
+	JOB_EVENT_LEADER_ELECTED  // 当选leader事件，从水位线补分派选举期间错过的调度
+)
+
+// 任务执行结果常量
+const (
+	JOB_STATUS_SUCCESS  = "success"  // 执行成功
+	JOB_STATUS_FAILED   = "failed"   // 执行失败
+	JOB_STATUS_TIMEOUT  = "timeout"  // 执行超时
+	JOB_STATUS_KILLED   = "killed"   // 被用户强杀
+	JOB_STATUS_REPLACED = "replaced" // 被Replace策略的新执行替换
+)
+
+// 强杀原因
+const (
+	JOB_KILL_REASON_USER    = "user"    // 用户通过master强杀
+	JOB_KILL_REASON_REPLACE = "replace" // Replace策略杀死上一次执行
+)
+
+// 重试退避方式
+const (
+	RETRY_BACKOFF_FIXED       = "fixed"       // 固定间隔
+	RETRY_BACKOFF_EXPONENTIAL = "exponential" // 指数退避
+
+	// 重试间隔的上限，未配置maxInterval时指数退避也不会超过它
+	RETRY_MAX_BACKOFF = 1 * time.Hour
+)
+
+// 超时强杀相关常量
+const (
+	// 默认的SIGTERM到SIGKILL宽限期
+	JOB_KILL_GRACE_PERIOD = 5 * time.Second
+
+	// SIGKILL后确认进程组全部退出的最长等待时间
+	JOB_KILL_CONFIRM_TIMEOUT = 5 * time.Second
+
+	// 命令退出后等待输出管道关闭的最长时间，后台进程持有管道时不再等待
+	JOB_OUTPUT_WAIT_DELAY = 5 * time.Second
+
+	// master等待强杀确认时，在宽限期和确认时间之外多等待的时间
+	JOB_KILLACK_EXTRA_WAIT = 2 * time.Second
+
+	// master等待强杀确认时轮询的间隔
+	JOB_KILLACK_POLL_INTERVAL = 200 * time.Millisecond
+
+	// 强杀确认的保留时间，单位秒
+	JOB_KILLACK_TTL = 60
+
+	// 正在执行的任务的租约，单位秒，执行期间自动续租
+	JOB_RUNNING_TTL = 10
+)
+
+// worker注册相关常量
+const (
+	// 注册的租约，单位秒
+	WORKER_REGISTER_TTL = 10
+
+	// 刷新注册信息的间隔
+	WORKER_REPORT_INTERVAL = 5 * time.Second
+)
+
+// 输出相关常量
+const (
+	// 默认的单次执行输出上限
+	JOB_MAX_OUTPUT_BYTES = 1024 * 1024
+
+	// 输出上限的最大值，日志文档还包括其他字段，不能超过MongoDB单文档16MB
+	JOB_MAX_OUTPUT_BYTES_LIMIT = 4 * 1024 * 1024
+
+	// 保存完整输出的GridFS bucket，文件名为执行ID
+	JOB_OUTPUT_BUCKET = "output"
+
+	// 输出分片的保留时间
+	LOG_CHUNK_TTL = 3 * 24 * time.Hour
+
+	// 结束标记等待写入队列的时间，MongoDB不可用时不阻塞执行结束
+	LOG_CHUNK_END_TIMEOUT = 5 * time.Second
+)
+
+// 输出分片的输出流
+const (
+	LOG_STREAM_STDOUT = "stdout" // 标准输出
+	LOG_STREAM_STDERR = "stderr" // 标准错误输出
+	LOG_STREAM_END    = "end"    // 命令结束标记
+)
+
+// 错过调度(misfire)的处理策略
+const (
+	MISFIRE_POLICY_SKIP     = "skip"    // 跳过错过的调度
+	MISFIRE_POLICY_RUN_ONCE = "runOnce" // 补执行一次(默认)
+	MISFIRE_POLICY_RUN_ALL  = "runAll"  // 逐个补执行，最多misfireMaxRuns次
+)
+
+// misfire相关常量
+const (
+	// 实际调度时间晚于计划时间超过该阈值，认为错过了调度，worker未配置时使用，单位秒
+	MISFIRE_THRESHOLD = 60
+
+	// runAll策略默认最多补执行的次数
+	MISFIRE_MAX_RUNS = 10
+
+	// leader分派补执行后等待水位线推进的最长时间，任务的超时时间更长时按超时时间等待
+	MISFIRE_DISPATCH_WAIT = 10 * time.Minute
+)
+
+// 任务并发策略
+const (
+	CONCURRENCY_POLICY_FORBID  = "Forbid"  // 禁止并发，上一次未结束则跳过本次(默认)
+	CONCURRENCY_POLICY_ALLOW   = "Allow"   // 允许并发，最多maxParallel个
+	CONCURRENCY_POLICY_REPLACE = "Replace" // 杀死正在执行的实例，再执行本次
+	CONCURRENCY_POLICY_QUEUE   = "Queue"   // 等待上一次执行结束后再执行本次
+)
+
+// 并发控制相关常量
+const (
+	// 等待锁释放的轮询间隔
+	LOCK_WAIT_INTERVAL = 1 * time.Second
+
+	// Replace策略在强杀宽限期之外，额外等待锁释放的时间
+	REPLACE_WAIT_TIMEOUT = 5 * time.Second
+
+	// Queue策略下同一任务在每个worker上的最大执行数(一个执行、一个排队)
+	QUEUE_MAX_LOCAL_EXECUTIONS = 2
+
+	// 锁的租约，单位秒，worker宕机后锁在租约过期后释放
+	JOB_LOCK_TTL = 5
+
+	// 调度认领在执行结束后保留的时间，单位秒，覆盖随机睡眠和worker之间的时钟偏差
+	JOB_FIRE_CLAIM_TTL = 60
+)
+
+// 任务的触发方式
+const (
+	JOB_TRIGGER_CRON     = "cron"     // 按cron表达式调度
+	JOB_TRIGGER_MANUAL   = "manual"   // 手动触发
+	JOB_TRIGGER_WORKFLOW = "workflow" // 工作流上游节点结束后触发
+)
+
+// 手动触发相关常量
+const (
+	// 触发请求的有效期，单位秒，过期未被执行则自动删除
+	JOB_TRIGGER_TTL = 60
+
+	// 触发状态的保留时间，单位秒
+	JOB_TRIGGER_STATUS_TTL = 24 * 3600
+)
+
+// 手动触发请求的状态
+const (
+	TRIGGER_STATUS_PENDING   = "pending"   // 等待worker认领
+	TRIGGER_STATUS_CLAIMED   = "claimed"   // 已被worker认领，等待上一次执行结束
+	TRIGGER_STATUS_RUNNING   = "running"   // 执行中
+	TRIGGER_STATUS_DONE      = "done"      // 执行结束，结果见执行日志
+	TRIGGER_STATUS_EXPIRED   = "expired"   // 有效期内没有被认领，或者等待上一次执行结束超时
+	TRIGGER_STATUS_CANCELED  = "canceled"  // 等待上一次执行结束时被强杀
+	TRIGGER_STATUS_BROADCAST = "broadcast" // 广播任务由每个worker执行，结果见/job/log/runs
+)
+
+// 工作流节点的触发条件
+const (
+	WORKFLOW_CONDITION_SUCCESS = "success" // 上游成功(默认)
+	WORKFLOW_CONDITION_FAILURE = "failure" // 上游失败
+	WORKFLOW_CONDITION_ALWAYS  = "always"  // 上游结束即可
+)
+
+// 工作流及节点的运行状态
+const (
+	WORKFLOW_STATUS_PENDING = "pending" // 等待上游
+	WORKFLOW_STATUS_RUNNING = "running" // 执行中
+	WORKFLOW_STATUS_SUCCESS = "success" // 成功
+	WORKFLOW_STATUS_FAILED  = "failed"  // 失败
+	WORKFLOW_STATUS_SKIPPED = "skipped" // 不满足触发条件，跳过
+)
+
+// 工作流相关常量
+const (
+	// 工作流运行记录的保留时间，单位秒
+	WORKFLOW_RUN_TTL = 7 * 24 * 3600
+
+	// 并发更新运行记录冲突时的重试次数
+	WORKFLOW_UPDATE_RETRY = 5
+
+	// 节点的触发请求过期后再等待的时间，超过后仍未执行的节点按失败处理，单位秒
+	WORKFLOW_NODE_GRACE = 60
+
+	// master检查卡住节点的间隔
+	WORKFLOW_REAP_INTERVAL = 30 * time.Second
+)
+
+// 任务执行环境相关常量
+const (
+	// 默认执行command的shell
+	JOB_DEFAULT_SHELL = "/bin/bash"
+
+	// 注入给任务的环境变量，用户不能自定义该前缀的变量
+	JOB_ENV_PREFIX      = "CRON_"
+	JOB_ENV_JOB_NAME    = "CRON_JOB_NAME"    // 任务名
+	JOB_ENV_PLAN_TIME   = "CRON_PLAN_TIME"   // 计划调度时间，RFC3339格式
+	JOB_ENV_RUN_ID      = "CRON_RUN_ID"      // 本次尝试的执行ID
+	JOB_ENV_ATTEMPT     = "CRON_ATTEMPT"     // 第几次尝试
+	JOB_ENV_TRIGGER     = "CRON_TRIGGER"     // 触发方式 cron manual workflow
+	JOB_ENV_SHARD_INDEX = "CRON_SHARD_INDEX" // 分片序号，从0开始，不分片为0
+	JOB_ENV_SHARD_TOTAL = "CRON_SHARD_TOTAL" // 分片总数，不分片为1
+)
+
+// 资源限制相关常量
+const (
+	// worker默认的cgroup v2目录，需要委派给worker
+	CGROUP_ROOT = "/sys/fs/cgroup/crontab"
+
+	// cpu.max的周期，单位微秒
+	CGROUP_CPU_PERIOD = 100000
+)
+
+// nodeSelector的匹配方式
+const (
+	LABEL_OPERATOR_IN             = "In"           // 标签值在values中
+	LABEL_OPERATOR_NOT_IN         = "NotIn"        // 没有该标签或者标签值不在values中
+	LABEL_OPERATOR_EXISTS         = "Exists"       // 有该标签
+	LABEL_OPERATOR_DOES_NOT_EXIST = "DoesNotExist" // 没有该标签
+)
+
+// 任务的执行方式
+const (
+	EXECUTION_MODE_SINGLE    = "single"    // 集群内只有一个worker执行
+	EXECUTION_MODE_BROADCAST = "broadcast" // 每个匹配的worker各执行一次
+)
+
+// 调度的分派方式，集群内的worker需要配置一致
+const (
+	DISPATCH_MODE_RACE   = "race"   // 每个worker都调度，随机睡眠后抢锁执行(默认)
+	DISPATCH_MODE_LEADER = "leader" // 选举出的leader调度，把每次执行分派给一个worker
+
+	DISPATCH_STRATEGY_LEAST_LOADED = "leastLoaded" // 分派给正在执行任务数最少的worker(默认)
+	DISPATCH_STRATEGY_HASH         = "hash"        // 按任务名一致性哈希，同一任务固定在同一worker
+)
+
+// worker下线相关常量
+const (
+	// 默认等待正在执行的任务结束的时间，单位秒
+	WORKER_DRAIN_TIMEOUT = 60
+
+	// 等待超时强杀剩余执行后，再等待它们结束的时间
+	WORKER_DRAIN_KILL_WAIT = JOB_KILL_GRACE_PERIOD + JOB_KILL_CONFIRM_TIMEOUT
+
+	// 等待日志写入MongoDB的时间
+	WORKER_DRAIN_FLUSH_TIMEOUT = 10 * time.Second
+
+	// 检查执行是否全部结束的间隔
+	WORKER_DRAIN_CHECK_INTERVAL = 500 * time.Millisecond
+
+	// 下线请求的有效期，单位秒
+	JOB_DRAIN_TTL = 60
+
+	// 注销时等待续租协程退出的时间，etcd不可用时不阻塞下线
+	WORKER_DEREGISTER_TIMEOUT = 5 * time.Second
+)
+
+// worker执行槽位用满时的处理方式
+const (
+	CAPACITY_POLICY_DECLINE = "decline" // 放弃本次执行，由其他worker抢锁执行(默认)
+	CAPACITY_POLICY_QUEUE   = "queue"   // 排队等待空闲槽位
+)
+
+// leader分派相关常量
+const (
+	// leader租约，单位秒，leader宕机后其他worker在租约过期后接替
+	JOB_LEADER_TTL = 5
+
+	// 分派记录的有效期，单位秒，worker没有接收时自动删除
+	JOB_ASSIGN_TTL = 60
+
+	// 一致性哈希每个worker的虚拟节点数
+	DISPATCH_HASH_REPLICAS = 100
 )
@@ -3,5 +3,44 @@ package common
 import "github.com/pkg/errors"
 
 var (
-	ERR_LOCK_ALREADY_REQUIRED = errors.New("the lock is already occupied")
+	ERR_LOCK_ALREADY_REQUIRED   = errors.New("the lock is already occupied")
+	ERR_NO_FREE_SLOT            = errors.New("the job reached its max parallel executions")
+	ERR_JOB_EXECUTE_TIMEOUT     = errors.New("job execute timeout")
+	ERR_JOB_RETRY_CANCELED      = errors.New("job retry canceled")
+	ERR_INVALID_RETRY           = errors.New("invalid job retry: attempts and intervals cannot be negative, jitter must be 0~1, backoff must be fixed or exponential")
+	ERR_FIRE_ALREADY_DONE       = errors.New("the fire time is already executed by another worker")
+	ERR_FIRE_ALREADY_CLAIMED    = errors.New("the fire time is already claimed by another worker")
+	ERR_INVALID_MISFIRE_POLICY  = errors.New("misfirePolicy must be one of skip, runOnce, runAll")
+	ERR_INVALID_CONCURRENCY     = errors.New("concurrencyPolicy must be one of Forbid, Allow, Replace, Queue")
+	ERR_JOB_NOT_FOUND           = errors.New("job not found")
+	ERR_JOB_CONFLICT            = errors.New("job was modified concurrently, please retry")
+	ERR_TRIGGER_ALREADY_CLAIMED = errors.New("the trigger is already claimed by another worker")
+	ERR_TRIGGER_NOT_FOUND       = errors.New("trigger not found")
+	ERR_INVALID_COMMAND         = errors.New("invalid job: either command or args is required, and shell cannot be used with args")
+	ERR_INVALID_ENV             = errors.New("invalid job env: names must be identifiers and cannot start with CRON_")
+	ERR_INVALID_PATH            = errors.New("invalid job: workingDir and shell must be absolute paths")
+	ERR_INVALID_RUN_AS          = errors.New("invalid job: runAsGroup requires runAsUser")
+	ERR_RUN_AS_NOT_ALLOWED      = errors.New("not allowed by this worker")
+	ERR_INVALID_RESOURCES       = errors.New("invalid job resources: limits cannot be negative")
+	ERR_JOB_KILLED              = errors.New("job killed by user")
+	ERR_JOB_REPLACED            = errors.New("job replaced by a newer run")
+	ERR_KILL_NOT_CONFIRMED      = errors.New("process group is still alive after SIGKILL")
+	ERR_INVALID_NODE_SELECTOR   = errors.New("invalid job nodeSelector: key is required, operator must be In NotIn Exists or DoesNotExist")
+	ERR_INVALID_EXECUTION_MODE  = errors.New("invalid job executionMode: must be single or broadcast")
+	ERR_INVALID_SHARDS          = errors.New("invalid job shards: cannot be negative or used with broadcast")
+	ERR_INVALID_DISPATCH        = errors.New("dispatchMode must be race or leader, dispatchStrategy must be leastLoaded or hash")
+	ERR_NO_DISPATCH_WORKER      = errors.New("no online worker matches the job")
+	ERR_INVALID_CAPACITY        = errors.New("maxConcurrentJobs cannot be negative, capacityPolicy must be decline or queue")
+	ERR_WORKER_SATURATED        = errors.New("worker reached maxConcurrentJobs")
+	ERR_JOB_QUEUE_CANCELED      = errors.New("job canceled while waiting for a free worker slot")
+	ERR_WORKER_DRAINING         = errors.New("worker is draining")
+	ERR_WORKER_NOT_FOUND        = errors.New("worker not found")
+	ERR_INVALID_WORKFLOW        = errors.New("invalid workflow: nodes must be unique and depends must reference existing nodes")
+	ERR_WORKFLOW_CYCLE          = errors.New("invalid workflow: depends contain a cycle")
+	ERR_WORKFLOW_NOT_FOUND      = errors.New("workflow not found")
+	ERR_WORKFLOW_RUN_EXISTS     = errors.New("workflow run already exists")
+	ERR_NO_RUNNING_LOG          = errors.New("no output found for the job")
+	ERR_INVALID_MAX_OUTPUT      = errors.New("maxOutputBytes cannot be negative or larger than 4MB")
+	ERR_NO_SPILLED_OUTPUT       = errors.New("full output was not saved, enable outputSpill on the worker")
+	ERR_STREAM_NOT_SUPPORTED    = errors.New("streaming is not supported")
 )
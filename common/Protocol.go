@@ -1,10 +1,17 @@
 package common
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/gorhill/cronexpr"
 	"golang.org/x/net/context"
+	"math"
+	mathrand "math/rand"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,22 +20,298 @@ type Job struct {
 	Name     string `json:"name"`
 	Command  string `json:"command"`
 	CronExpr string `json:"cronExpr"` // cron表达式
+	Paused   bool   `json:"paused"`   // 是否暂停，暂停的任务不再调度
+	Timezone string `json:"timezone"` // cron表达式所在时区(IANA名称，如Asia/Shanghai)，为空使用worker本地时区
+
+	Timeout         int `json:"timeout"`         // 执行超时时间，单位秒，0表示不限制
+	KillGracePeriod int `json:"killGracePeriod"` // 超时后SIGTERM到SIGKILL的宽限时间，单位秒
+
+	Retry *RetryPolicy `json:"retry,omitempty"` // 失败重试策略，为空不重试
+
+	MaxOutputBytes int64 `json:"maxOutputBytes"` // 输出上限，单位字节，0表示使用worker的配置
+
+	MisfirePolicy  string `json:"misfirePolicy"`  // 错过调度的处理策略 skip runOnce runAll，默认runOnce
+	MisfireMaxRuns int    `json:"misfireMaxRuns"` // runAll策略最多补执行的次数
+
+	ConcurrencyPolicy string `json:"concurrencyPolicy"` // 并发策略 Forbid Allow Replace Queue，默认Forbid
+	MaxParallel       int    `json:"maxParallel"`       // Allow策略集群内最多同时执行的个数，0表示不限制
+
+	Env        map[string]string `json:"env"`        // 追加的环境变量
+	WorkingDir string            `json:"workingDir"` // 工作目录，绝对路径，为空使用worker的工作目录
+	Shell      string            `json:"shell"`      // 执行command的shell，绝对路径，默认/bin/bash
+	Args       []string          `json:"args"`       // 不经过shell直接执行的命令及参数，设置后忽略command
+
+	RunAsUser  string `json:"runAsUser"`  // 以指定用户执行(用户名或uid)，需要worker允许，为空与worker相同
+	RunAsGroup string `json:"runAsGroup"` // 以指定组执行(组名或gid)，为空使用用户的主组
+
+	Resources *ResourceLimits `json:"resources,omitempty"` // 资源限制，为空不限制
+
+	NodeSelector []*LabelRequirement `json:"nodeSelector"` // worker标签需要满足的条件，全部满足才能执行，为空所有worker都可以执行
+
+	ExecutionMode string `json:"executionMode"` // 执行方式 single只在一个worker执行(默认) broadcast在每个匹配的worker上各执行一次
+
+	Shards int `json:"shards"` // 分片数，每次调度产生shards个执行，分散到各个worker，0和1表示不分片
+}
+
+// 是否为广播任务
+func (job *Job) IsBroadcast() bool {
+	return job.ExecutionMode == EXECUTION_MODE_BROADCAST
+}
+
+// 标签匹配条件
+type LabelRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"` // In NotIn Exists DoesNotExist
+	Values   []string `json:"values"`   // In和NotIn使用
+}
+
+// 标签是否满足条件，空条件不做限制(校验前保存的任务可能包含null)
+func (requirement *LabelRequirement) Matches(labels map[string]string) bool {
+	if requirement == nil {
+		return true
+	}
+
+	value, exists := labels[requirement.Key]
+
+	switch requirement.Operator {
+	case LABEL_OPERATOR_IN:
+		return exists && containsString(requirement.Values, value)
+	case LABEL_OPERATOR_NOT_IN:
+		return !exists || !containsString(requirement.Values, value)
+	case LABEL_OPERATOR_EXISTS:
+		return exists
+	case LABEL_OPERATOR_DOES_NOT_EXIST:
+		return !exists
+	}
+	return false
+}
+
+// worker的标签是否满足任务的nodeSelector
+func (job *Job) MatchLabels(labels map[string]string) bool {
+	for _, requirement := range job.NodeSelector {
+		if !requirement.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// 校验nodeSelector
+func (job *Job) ValidateNodeSelector() error {
+	for _, requirement := range job.NodeSelector {
+		if requirement == nil || requirement.Key == "" {
+			return ERR_INVALID_NODE_SELECTOR
+		}
+		switch requirement.Operator {
+		case LABEL_OPERATOR_IN, LABEL_OPERATOR_NOT_IN:
+			if len(requirement.Values) == 0 {
+				return ERR_INVALID_NODE_SELECTOR
+			}
+		case LABEL_OPERATOR_EXISTS, LABEL_OPERATOR_DOES_NOT_EXIST:
+			if len(requirement.Values) != 0 {
+				return ERR_INVALID_NODE_SELECTOR
+			}
+		default:
+			return ERR_INVALID_NODE_SELECTOR
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// 资源限制，worker为每次执行创建cgroup v2子目录
+type ResourceLimits struct {
+	CpuQuota  float64 `json:"cpuQuota"`  // 可以使用的cpu核数，如0.5，0表示不限制
+	MemoryMax int64   `json:"memoryMax"` // 内存上限，单位字节，0表示不限制
+	PidsMax   int64   `json:"pidsMax"`   // 进程数上限，0表示不限制
+}
+
+// 是否配置了资源限制
+func (limits *ResourceLimits) IsEmpty() bool {
+	return limits == nil || (limits.CpuQuota <= 0 && limits.MemoryMax <= 0 && limits.PidsMax <= 0)
+}
+
+// 任务的完整命令行，用于展示和日志
+func (job *Job) GetCommandLine() string {
+	if len(job.Args) != 0 {
+		return strings.Join(job.Args, " ")
+	}
+	return job.Command
+}
+
+// 执行command的shell
+func (job *Job) GetShell() string {
+	if job.Shell == "" {
+		return JOB_DEFAULT_SHELL
+	}
+	return job.Shell
+}
+
+// 分布式锁的值，记录持有锁的执行
+type JobLockValue struct {
+	RunId    string `json:"runId"`    // 执行ID
+	PlanTime int64  `json:"planTime"` // 计划时间，单位毫秒
+	Trigger  string `json:"trigger"`  // 触发方式 cron manual workflow
+}
+
+// 强杀任务的请求，写在/cron/killer/任务名
+type JobKiller struct {
+	RunId  string `json:"runId"`  // 只杀死指定的执行，为空杀死该任务所有的执行
+	KillId string `json:"killId"` // 强杀请求ID，worker按它回写确认，为空不需要确认
+	Reason string `json:"reason"` // 强杀原因 user replace，为空视为user
+}
+
+// worker对强杀请求的确认，写在/cron/killack/强杀请求ID/worker/执行ID
+// worker收到请求时先写一条执行ID为空的确认，列出要杀死的执行，每个执行确认退出后再各写一条
+type KillAck struct {
+	KillId   string   `json:"killId"`
+	JobName  string   `json:"jobName"`
+	Worker   string   `json:"worker"`   // 确认的worker
+	Running  bool     `json:"running"`  // 该worker上是否有正在执行的任务
+	Killing  []string `json:"killing"`  // 要杀死的执行ID，只在worker的确认中设置
+	RunId    string   `json:"runId"`    // 被杀死的执行ID
+	Pid      int      `json:"pid"`      // 被杀死的进程，即进程组ID，还未启动命令时为0
+	KillTime int64    `json:"killTime"` // 确认进程组退出的时间，单位毫秒
+	Err      string   `json:"err"`      // 未能确认退出时的错误
+}
+
+// worker节点信息，注册在/cron/workers/ip
+type WorkerInfo struct {
+	Ip         string            `json:"ip"`
+	Hostname   string            `json:"hostname"`
+	Version    string            `json:"version"`    // worker的构建版本
+	StartTime  int64             `json:"startTime"`  // worker启动时间，单位毫秒
+	CpuCount   int               `json:"cpuCount"`   // cpu核数
+	Labels     map[string]string `json:"labels"`     // worker.json中配置的标签
+	Running    int               `json:"running"`    // 正在执行的任务数
+	UsedSlots  int               `json:"usedSlots"`  // 占用的执行槽位数
+	MaxSlots   int               `json:"maxSlots"`   // 执行槽位上限，即maxConcurrentJobs，0表示不限制
+	Load       [3]float64        `json:"load"`       // 1、5、15分钟的系统负载
+	UpdateTime int64             `json:"updateTime"` // 信息更新时间，单位毫秒
+}
+
+// worker下线请求，写在/cron/drain/ip
+type DrainRequest struct {
+	Ip          string `json:"ip"`
+	Timeout     int    `json:"timeout"`     // 等待正在执行的任务结束的时间，单位秒，0使用worker配置
+	RequestTime int64  `json:"requestTime"` // 请求时间，单位毫秒
+}
+
+// 正在执行的任务，写在/cron/running/任务名/执行ID
+type RunningJob struct {
+	JobName      string `json:"jobName"`
+	RunId        string `json:"runId"`        // 执行ID，与重试无关，强杀时按它匹配
+	AttemptRunId string `json:"attemptRunId"` // 本次尝试的执行ID，日志和输出按它查询，首次尝试与RunId相同
+	Worker       string `json:"worker"`       // 执行的worker
+	Pid          int    `json:"pid"`          // 命令的进程ID
+	Attempt      int    `json:"attempt"`      // 第几次尝试
+	Trigger      string `json:"trigger"`      // 触发方式 cron manual workflow
+	PlanTime     int64  `json:"planTime"`     // 计划调度时间，单位毫秒
+	StartTime    int64  `json:"startTime"`    // 命令启动时间，单位毫秒
+}
+
+// 强杀接口的结果
+type KillResult struct {
+	KillId  string     `json:"killId"`
+	Acks    []*KillAck `json:"acks"`    // 已确认退出的执行
+	Pending []string   `json:"pending"` // 还没有确认，或者还有执行没有退出的worker
+	Done    bool       `json:"done"`    // 在线的worker都已确认
+}
+
+// 失败重试策略
+type RetryPolicy struct {
+	MaxAttempts      int     `json:"maxAttempts"`      // 最大执行次数(包含首次执行)
+	Backoff          string  `json:"backoff"`          // 退避方式 fixed exponential
+	Interval         int     `json:"interval"`         // 重试间隔，单位秒；指数退避时为首次间隔
+	MaxInterval      int     `json:"maxInterval"`      // 指数退避的间隔上限，单位秒，0表示不限制
+	Jitter           float64 `json:"jitter"`           // 随机抖动比例，取值0~1
+	RetryOnExitCodes []int   `json:"retryOnExitCodes"` // 只对这些退出码重试，为空表示任意失败都重试
+}
+
+// 手动触发请求的状态，写在/cron/trigger_status/触发ID，调用方轮询确认是否执行
+type JobTriggerStatus struct {
+	TriggerId  string `json:"triggerId"`
+	JobName    string `json:"jobName"`
+	Status     string `json:"status"`     // pending claimed running done expired canceled broadcast
+	Worker     string `json:"worker"`     // 认领的worker
+	Err        string `json:"err"`        // 过期或者取消的原因
+	UpdateTime int64  `json:"updateTime"` // 更新时间，单位毫秒
+	RetryTime  int64  `json:"retryTime"`  // 失败后下一次重试的时间，单位毫秒
+}
+
+// 手动触发任务的请求，写在/cron/trigger/任务名/触发ID
+type JobTrigger struct {
+	TriggerId   string            `json:"triggerId"`   // 触发ID，同时作为本次执行ID
+	Job         *Job              `json:"job"`         // 触发时的任务定义
+	Env         map[string]string `json:"env"`         // 覆盖的环境变量
+	Args        []string          `json:"args"`        // 追加的命令参数，shell命令中通过$1 $2...引用
+	TriggerTime int64             `json:"triggerTime"` // 触发时间，单位毫秒
+
+	WorkflowName  string `json:"workflowName"`  // 工作流节点触发时，所属的工作流
+	WorkflowRunId string `json:"workflowRunId"` // 工作流节点触发时，工作流的运行ID
+
+	ShardIndex int `json:"shardIndex"` // 分片任务手动触发时，本次执行的分片
+	ShardTotal int `json:"shardTotal"` // 分片总数，0表示不分片，工作流节点整体执行一次
+}
+
+// leader分派给worker的一次执行，存储在/cron/assign/ip/执行ID
+type JobAssignment struct {
+	RunId      string   `json:"runId"`      // 执行ID，leader生成
+	Job        *Job     `json:"job"`        // 分派时的任务定义
+	Worker     string   `json:"worker"`     // 执行的worker
+	Leader     string   `json:"leader"`     // 分派的leader
+	PlanTime   int64    `json:"planTime"`   // 计划调度时间，单位毫秒
+	AssignTime int64    `json:"assignTime"` // 分派时间，单位毫秒
+	IsMisfire  bool     `json:"isMisfire"`  // 是否为错过调度后的补执行
+	ShardIndex int      `json:"shardIndex"` // 分片序号
+	ShardTotal int      `json:"shardTotal"` // 分片总数，0表示不分片
+	Declined   []string `json:"declined"`   // 拒绝过本次执行的worker，重新分派时跳过
 }
 
 // 任务调度计划
 type JobSchedulerPlan struct {
 	Job      *Job
 	Expr     *cronexpr.Expression // cron表达式
+	Location *time.Location       // cron表达式所在时区
 	NextTime time.Time            // 下次调度时间
+	Index    int                  // 在调度堆中的下标，-1表示不在堆中
+	Misfires []time.Time          // 等待补执行的计划时间
+	Workflow *Workflow            // 工作流的调度计划，任务的调度计划为空
+
+	MisfireWait *MisfireWait // leader分派的补执行，执行结束前不分派下一个
+}
+
+// leader分派的补执行，执行在其他worker上，通过水位线的推进判断执行结束
+type MisfireWait struct {
+	PlanTime time.Time       // 补执行的计划时间
+	Waiting  map[string]bool // 还没有推进到PlanTime的水位线名称，分片任务每个分片一个
+	Deadline time.Time       // 执行被拒绝或者分派丢失时水位线不会推进，超过后不再等待
 }
 
 // 任务执行状态
 type JobExecuteInfo struct {
 	Job        *Job
+	RunId      string             // 本次执行ID
 	PlanTime   time.Time          // 理论执行时间
 	RealTime   time.Time          // 实际执行时间
+	IsMisfire  bool               // 是否为错过调度后的补执行
+	Trigger    *JobTrigger        // 手动触发的请求，按cron调度时为空
+	ShardIndex int                // 分片序号，从0开始
+	ShardTotal int                // 分片总数，0表示不分片
+	IsAssigned bool               // 是否为leader分派的执行
 	CommandCtx context.Context    // 用于command的context
 	CancelFunc context.CancelFunc // 用于取消command命令
+
+	killerLock sync.Mutex   // 调度协程写入强杀请求，执行协程读取
+	killers    []*JobKiller // 收到的强杀请求
 }
 
 // http接口应答
@@ -40,17 +323,40 @@ type Response struct {
 
 // 变化事件
 type JobEvent struct {
-	EventType int // 事件类型save delete
-	Job       *Job
+	EventType  int // 事件类型save delete
+	Job        *Job
+	Killer     *JobKiller           // 强杀请求，killer事件使用
+	Trigger    *JobTrigger          // 手动触发请求，trigger事件使用
+	Workflow   *Workflow            // 工作流，workflow事件使用
+	Assignment *JobAssignment       // leader分派的执行，assign事件使用
+	Watermark  time.Time            // 最近一次执行的计划时间，worker启动时加载，用于补执行；watermark事件为推进后的值
+	Watermarks map[string]time.Time // 所有的水位线，当选leader时加载
+
+	WatermarkName string // 推进的水位线名称，分片任务为任务名/分片序号，watermark事件使用
 }
 
 // 任务执行结果
 type JobExecuteResult struct {
 	ExecuteInfo *JobExecuteInfo // 执行状态
-	Output      []byte          // 脚本输出
+	Output      []byte          // 脚本输出(stdout和stderr合并)
+	Stdout      []byte          // 标准输出
+	Stderr      []byte          // 标准错误输出
+	ExitCode    int             // 退出码，未正常退出为-1
+	Pid         int             // 命令的进程ID，未启动为0
+	Signal      string          // 终止进程的信号
+	OutputSize  int64           // 实际输出的总字节数
+	IsTruncated bool            // 输出是否被截断
+	IsSpilled   bool            // 完整输出是否保存在GridFS
+	PeakMemory  int64           // 内存使用峰值，单位字节
+	CpuTime     time.Duration   // cpu时间，用户态和内核态之和
 	Err         error           // 脚本错误信息
 	StartTime   time.Time       // 启动时间
 	EndTime     time.Time       // 结束时间
+	IsTimeout   bool            // 是否执行超时
+	RunId       string          // 本次尝试的执行ID
+	ParentRunId string          // 首次尝试的执行ID，重试时填写
+	Attempt     int             // 第几次尝试，从1开始
+	IsRetrying  bool            // 后续还有重试，任务仍在执行中
 }
 
 // 任务执行日志结果
@@ -58,11 +364,44 @@ type JobLog struct {
 	JobName      string `json:"jobName" bson:"jobName"`           // 任务名称
 	Command      string `json:"command" bson:"command"`           // shell命令
 	Output       string `json:"output" bson:"output"`             // 执行输出
+	Stdout       string `json:"stdout" bson:"stdout"`             // 标准输出
+	Stderr       string `json:"stderr" bson:"stderr"`             // 标准错误输出
+	ExitCode     int    `json:"exitCode" bson:"exitCode"`         // 退出码
+	Signal       string `json:"signal" bson:"signal"`             // 终止进程的信号
+	Worker       string `json:"worker" bson:"worker"`             // 执行任务的worker ip
+	OutputSize   int64  `json:"outputSize" bson:"outputSize"`     // 实际输出的总字节数
+	Truncated    bool   `json:"truncated" bson:"truncated"`       // 输出是否被截断
+	Spilled      bool   `json:"spilled" bson:"spilled"`           // 完整输出是否可以通过/job/log/output获取
+	PeakMemory   int64  `json:"peakMemory" bson:"peakMemory"`     // 内存使用峰值，单位字节
+	CpuTime      int64  `json:"cpuTime" bson:"cpuTime"`           // cpu时间，单位毫秒
 	Err          string `json:"err" bson:"err"`                   // err输出
 	PlanTime     int64  `json:"planTime" bson:"planTime"`         // 计划调度时间
 	ScheduleTime int64  `json:"scheduleTime" bson:"scheduleTime"` // 开始调度时间
 	StartTime    int64  `json:"startTime" bson:"startTime"`       // 命令执行开始时间
 	EndTime      int64  `json:"endTime" bson:"endTime"`           // 命令执行结束时间
+	Duration     int64  `json:"duration" bson:"duration"`         // 执行耗时，单位毫秒
+	Status       string `json:"status" bson:"status"`             // 执行结果 success failed timeout
+	Misfire      bool   `json:"misfire" bson:"misfire"`           // 是否为错过调度后的补执行
+	Trigger      string `json:"trigger" bson:"trigger"`           // 触发方式 cron manual workflow
+	WorkflowName string `json:"workflowName" bson:"workflowName"` // 所属的工作流
+	WorkflowRun  string `json:"workflowRun" bson:"workflowRun"`   // 工作流的运行ID
+	ShardIndex   int    `json:"shardIndex" bson:"shardIndex"`     // 分片序号
+	ShardTotal   int    `json:"shardTotal" bson:"shardTotal"`     // 分片总数，0表示不分片
+	RunId        string `json:"runId" bson:"runId"`               // 执行ID
+	ParentRunId  string `json:"parentRunId" bson:"parentRunId"`   // 首次尝试的执行ID
+	Attempt      int    `json:"attempt" bson:"attempt"`           // 第几次尝试
+}
+
+// 任务输出分片，命令执行过程中实时写入
+type JobLogChunk struct {
+	JobName string `json:"jobName" bson:"jobName"` // 任务名称
+	RunId   string `json:"runId" bson:"runId"`     // 执行ID
+	Seq     int64  `json:"seq" bson:"seq"`         // 分片序号，从1开始
+	Stream  string `json:"stream" bson:"stream"`   // 输出流 stdout stderr end
+	Data    string `json:"data" bson:"data"`       // 输出内容
+	Time    int64  `json:"time" bson:"time"`       // 写入时间，单位毫秒
+
+	CreateTime time.Time `json:"-" bson:"createTime"` // 写入时间，用于过期索引
 }
 
 // 日志批次
@@ -80,6 +419,98 @@ type SortLogByStartTime struct {
 	SortOrder int `bson:"startTime"` // {startTime:-1}
 }
 
+// 广播任务的日志过滤条件 {jobName:xxx, planTime:{$in:[...]}}
+type BroadcastLogFilter struct {
+	JobName  string  `bson:"jobName"`
+	PlanTime InInt64 `bson:"planTime"`
+}
+
+type InInt64 struct {
+	In []int64 `bson:"$in"`
+}
+
+// 任务的计划时间聚合阶段
+// [{$match:{jobName:xxx}}, {$group:{_id:"$planTime"}}, {$sort:{_id:-1}}, {$skip:n}, {$limit:n}]
+type MatchJobLog struct {
+	Match JobLogFilter `bson:"$match"`
+}
+
+type GroupByPlanTime struct {
+	Group PlanTimeGroupId `bson:"$group"`
+}
+
+type PlanTimeGroupId struct {
+	Id string `bson:"_id"` // "$planTime"
+}
+
+type SortPlanTimeGroup struct {
+	Sort SortByGroupId `bson:"$sort"`
+}
+
+type SortByGroupId struct {
+	SortOrder int `bson:"_id"` // {_id:-1}
+}
+
+type SkipStage struct {
+	Skip int64 `bson:"$skip"`
+}
+
+type LimitStage struct {
+	Limit int64 `bson:"$limit"`
+}
+
+// 聚合得到的计划时间
+type PlanTimeGroup struct {
+	PlanTime int64 `bson:"_id"`
+}
+
+// 日志按任务和计划时间的索引
+type JobLogPlanTimeIndex struct {
+	JobName  int `bson:"jobName"` // {jobName:1, planTime:1}
+	PlanTime int `bson:"planTime"`
+}
+
+// 一次调度产生的多个执行汇总成一次逻辑上的运行：广播任务按worker、分片任务按分片
+type JobRunGroup struct {
+	PlanTime int64     `json:"planTime"` // 计划调度时间，单位毫秒
+	Total    int       `json:"total"`    // 分片任务的分片总数，广播任务为已上报的worker数
+	Success  int       `json:"success"`  // 成功的个数
+	Failed   int       `json:"failed"`   // 失败、超时、被强杀的个数
+	Logs     []*JobLog `json:"logs"`     // 每个worker或分片最后一次尝试的日志
+}
+
+// 输出分片过滤条件 {runId:xxx, seq:{$gt:n}}
+type JobLogChunkFilter struct {
+	RunId string      `bson:"runId"`
+	Seq   GreaterThan `bson:"seq"`
+}
+
+// 大于条件
+type GreaterThan struct {
+	Gt int64 `bson:"$gt"`
+}
+
+// 输出分片排序规则
+type SortLogChunkBySeq struct {
+	SortOrder int `bson:"seq"` // {seq:1}
+}
+
+// 输出分片按写入时间排序
+type SortLogChunkByTime struct {
+	SortOrder int `bson:"time"` // {time:-1}
+}
+
+// 输出分片按执行ID和序号的索引
+type LogChunkRunIndex struct {
+	RunId int `bson:"runId"` // {runId:1, seq:1}
+	Seq   int `bson:"seq"`
+}
+
+// 输出分片的过期索引
+type LogChunkTTLIndex struct {
+	CreateTime int `bson:"createTime"` // {createTime:1}
+}
+
 // 应答方法
 func BuildResponse(errno int, msg string, data interface{}) (resp []byte, err error) {
 	// 定义response
@@ -116,6 +547,139 @@ func ExtractKillerName(jobKey string) (jobName string) {
 	return strings.TrimPrefix(jobKey, JOB_KILLER_DIR)
 }
 
+// 从etcd的key中提取任务名称
+func ExtractWatermarkName(jobKey string) (jobName string) {
+	return strings.TrimPrefix(jobKey, JOB_WATERMARK_DIR)
+}
+
+// 水位线编码，补齐位数保证etcd按字符串比较的结果与时间先后一致
+func EncodeWatermark(planTime time.Time) string {
+	return fmt.Sprintf("%020d", planTime.UnixNano()/1e6)
+}
+
+// 水位线解码
+func DecodeWatermark(value []byte) (planTime time.Time, err error) {
+	msec, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return
+	}
+	planTime = time.Unix(0, msec*1e6)
+	return
+}
+
+// 分布式锁的值
+func BuildJobLockValue(info *JobExecuteInfo) string {
+	value, _ := json.Marshal(&JobLockValue{
+		RunId:    info.RunId,
+		PlanTime: info.PlanTime.UnixNano() / 1e6,
+		Trigger:  info.GetTriggerType(),
+	})
+	return string(value)
+}
+
+// 解析分布式锁的值，旧版本的锁只记录执行ID，按cron调度处理
+func DecodeJobLockValue(value []byte) (lockValue *JobLockValue) {
+	lockValue = &JobLockValue{}
+	if err := json.Unmarshal(value, lockValue); err != nil || lockValue.RunId == "" {
+		lockValue = &JobLockValue{RunId: string(value), Trigger: JOB_TRIGGER_CRON}
+	}
+	return
+}
+
+// 任务锁路径
+func BuildJobLockKey(jobName string) string {
+	return JOB_LOCK_DIR + jobName
+}
+
+// 广播任务在某个worker上的锁名称，替代任务名构建锁路径
+func BuildWorkerLockName(jobName string, workerIp string) string {
+	return jobName + "/worker/" + workerIp
+}
+
+// 分片的名称，替代任务名构建锁路径和水位线
+func BuildShardName(jobName string, shard int) string {
+	return jobName + "/" + strconv.Itoa(shard)
+}
+
+// 从分片名中提取任务名，不分片时就是任务名
+func ExtractShardJobName(shardName string) (jobName string) {
+	index := strings.LastIndex(shardName, "/")
+	if index < 0 {
+		return shardName
+	}
+	if _, err := strconv.Atoi(shardName[index+1:]); err != nil {
+		return shardName
+	}
+	return shardName[:index]
+}
+
+// 某个计划时间的认领路径，保证一次调度只在一个worker执行
+func BuildFireLockKey(jobName string, planTime time.Time) string {
+	return fmt.Sprintf("%s%s/fire/%d", JOB_LOCK_DIR, jobName, planTime.UnixNano()/1e6)
+}
+
+// 并发槽位的锁路径，限制任务在集群内的并发数
+func BuildSlotLockKey(jobName string, slot int) string {
+	return fmt.Sprintf("%s%s/slot/%d", JOB_LOCK_DIR, jobName, slot)
+}
+
+// 正在执行的任务的路径
+func BuildRunningKey(jobName string, runId string) string {
+	return JOB_RUNNING_DIR + jobName + "/" + runId
+}
+
+// 强杀确认的路径，runId为空是worker本身的确认
+func BuildKillAckKey(killId string, worker string, runId string) string {
+	return JOB_KILLACK_DIR + killId + "/" + worker + "/" + runId
+}
+
+// 手动触发请求的路径
+func BuildTriggerKey(trigger *JobTrigger) string {
+	return JOB_TRIGGER_DIR + trigger.Job.Name + "/" + trigger.TriggerId
+}
+
+// 触发状态的路径
+func BuildTriggerStatusKey(triggerId string) string {
+	return JOB_TRIGGER_STATUS_DIR + triggerId
+}
+
+// 反序列化trigger
+func UnpackTrigger(value []byte) (ret *JobTrigger, err error) {
+	var trigger JobTrigger
+	if err = json.Unmarshal(value, &trigger); err != nil {
+		return
+	}
+
+	ret = &trigger
+	return
+}
+
+// 分派记录的路径
+func BuildAssignKey(assignment *JobAssignment) string {
+	return JOB_ASSIGN_DIR + assignment.Worker + "/" + assignment.RunId
+}
+
+// 交还leader的分派记录路径
+func BuildAssignReturnKey(assignment *JobAssignment) string {
+	return JOB_ASSIGN_RETURN_DIR + assignment.RunId
+}
+
+// 反序列化分派记录
+func UnpackAssignment(value []byte) (ret *JobAssignment, err error) {
+	var assignment JobAssignment
+	if err = json.Unmarshal(value, &assignment); err != nil {
+		return
+	}
+
+	ret = &assignment
+	return
+}
+
+// worker是否拒绝过本次执行
+func (assignment *JobAssignment) IsDeclinedBy(worker string) bool {
+	return containsString(assignment.Declined, worker)
+}
+
 // 从etcd的key中提取worker ip
 func ExtractWorkerIp(Key string) (workerIp string) {
 	return strings.TrimPrefix(Key, JOB_WORKER_DIR)
@@ -129,6 +693,14 @@ func BuildJobEvent(eventType int, job *Job) (jobEvent *JobEvent) {
 	}
 }
 
+// 任务的时区，为空使用本地时区
+func (job *Job) GetLocation() (loc *time.Location, err error) {
+	if job.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(job.Timezone)
+}
+
 // 构造任务执行计划
 func BuildJobSchedulerPlan(job *Job) (jobSchedulerPlan *JobSchedulerPlan, err error) {
 	// 解析job的cron表达式
@@ -137,19 +709,228 @@ func BuildJobSchedulerPlan(job *Job) (jobSchedulerPlan *JobSchedulerPlan, err er
 		return
 	}
 
+	// 解析任务时区
+	loc, err := job.GetLocation()
+	if err != nil {
+		return
+	}
+
 	jobSchedulerPlan = &JobSchedulerPlan{
 		Job:      job,
 		Expr:     expr,
-		NextTime: expr.Next(time.Now()),
+		Location: loc,
+		Index:    -1,
+	}
+	jobSchedulerPlan.NextTime = jobSchedulerPlan.Next(time.Now())
+
+	return
+}
+
+// 计算from之后的下次调度时间，cron表达式按任务时区的挂钟时间解析
+// 夏令时跳过的挂钟时刻(如02:30不存在)顺延到跳变时刻执行一次
+// 夏令时回拨重复出现的挂钟时刻只在第一次出现时执行
+func (jobSchedulerPlan *JobSchedulerPlan) Next(from time.Time) (next time.Time) {
+	// cronexpr在有夏令时的时区直接计算会出错，在没有夏令时的UTC中按挂钟时间计算，再换算回任务时区
+	wall := wallClock(from.In(jobSchedulerPlan.Location))
+
+	for i := 0; i < 3; i++ {
+		if wall = jobSchedulerPlan.Expr.Next(wall); wall.IsZero() {
+			return
+		}
+
+		if next = resolveWallClock(wall, jobSchedulerPlan.Location); next.After(from) {
+			return
+		}
+
+		// 只有回拨期间第二次经过重复的挂钟时刻时，第一次出现早于from，跳过整段重复的挂钟时间
+		_, end := next.ZoneBounds()
+		if end.IsZero() {
+			continue
+		}
+		_, offset := next.Zone()
+		if _, laterOffset := end.Zone(); laterOffset < offset {
+			wall = wallClock(end).Add(time.Duration(offset-laterOffset)*time.Second - time.Second)
+		}
+	}
+
+	return time.Time{}
+}
+
+// 把时间的挂钟时刻表示为UTC时间
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// 把UTC表示的挂钟时刻换算为loc中的时间
+// 跳变跳过的挂钟时刻返回跳变时刻，回拨重复的挂钟时刻返回第一次出现的时间
+func resolveWallClock(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+	start, end := t.ZoneBounds()
+
+	// 挂钟时刻不存在，跳变时刻是跳变前挂钟早于wall、跳变后晚于wall的时区边界
+	if !wallClock(t).Equal(wall) {
+		if !start.IsZero() && wallClock(start).After(wall) && wallClock(start.Add(-time.Nanosecond)).Before(wall) {
+			return start
+		}
+		return end
+	}
+
+	// 挂钟时刻重复出现，上一个时区的偏移更大时可能存在更早的一次
+	if !start.IsZero() {
+		_, offset := t.Zone()
+		_, prevOffset := start.Add(-time.Nanosecond).Zone()
+		if prevOffset > offset {
+			if earlier := t.Add(-time.Duration(prevOffset-offset) * time.Second); wallClock(earlier).Equal(wall) {
+				return earlier
+			}
+		}
+	}
+	return t
+}
+
+// 任务的强杀宽限期
+func (job *Job) GetKillGracePeriod() time.Duration {
+	if job.KillGracePeriod <= 0 {
+		return JOB_KILL_GRACE_PERIOD
+	}
+	return time.Duration(job.KillGracePeriod) * time.Second
+}
+
+// 判断第attempt次尝试失败后是否需要重试
+func (policy *RetryPolicy) ShouldRetry(attempt int, exitCode int) bool {
+	if policy == nil || attempt >= policy.MaxAttempts {
+		return false
+	}
+
+	// 未指定退出码，任意失败都重试
+	if len(policy.RetryOnExitCodes) == 0 {
+		return true
+	}
+
+	for _, code := range policy.RetryOnExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验重试策略
+func (policy *RetryPolicy) Validate() error {
+	if policy == nil {
+		return nil
+	}
+
+	switch policy.Backoff {
+	case "", RETRY_BACKOFF_FIXED, RETRY_BACKOFF_EXPONENTIAL:
+	default:
+		return ERR_INVALID_RETRY
 	}
 
+	if policy.MaxAttempts < 0 || policy.Interval < 0 || policy.MaxInterval < 0 || policy.Jitter < 0 || policy.Jitter > 1 {
+		return ERR_INVALID_RETRY
+	}
+	return nil
+}
+
+// 计算第attempt次尝试失败后的等待时间，不超过maxInterval和RETRY_MAX_BACKOFF
+func (policy *RetryPolicy) GetBackoff(attempt int) (backoff time.Duration) {
+	maxBackoff := RETRY_MAX_BACKOFF
+	if maxInterval := time.Duration(policy.MaxInterval) * time.Second; maxInterval > 0 && maxInterval < maxBackoff {
+		maxBackoff = maxInterval
+	}
+
+	// 用浮点数计算，先和上限比较再转换，避免溢出
+	interval := float64(policy.Interval) * float64(time.Second)
+	if policy.Backoff == RETRY_BACKOFF_EXPONENTIAL && attempt > 1 {
+		interval *= math.Pow(2, float64(attempt-1))
+	}
+	if interval > float64(maxBackoff) {
+		interval = float64(maxBackoff)
+	}
+
+	// 随机抖动，避免大量任务同时重试
+	if policy.Jitter > 0 {
+		interval += interval * policy.Jitter * (2*mathrand.Float64() - 1)
+	}
+
+	if interval < 0 {
+		interval = 0
+	}
+	return time.Duration(interval)
+}
+
+// 生成执行ID
+func BuildRunId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// 计算错过的计划时间，from是第一个错过的计划时间，只返回最近的maxRuns个
+// 从now向前按倍增的窗口查找，停机很久后不需要遍历所有错过的调度
+func (jobSchedulerPlan *JobSchedulerPlan) MissedTimes(from time.Time, now time.Time, maxRuns int) (missed []time.Time) {
+	if maxRuns <= 0 || from.After(now) {
+		return
+	}
+
+	// 初始窗口按第一个调度周期估算，能容纳maxRuns次调度
+	period := time.Second
+	if next := jobSchedulerPlan.Next(from); !next.IsZero() && next.Sub(from) > period {
+		period = next.Sub(from)
+	}
+	span := now.Sub(from)
+	if period > span/time.Duration(maxRuns) {
+		return jobSchedulerPlan.collectTimes(from, now, maxRuns)
+	}
+
+	for window := period * time.Duration(maxRuns); window < span; window *= 2 {
+		start := jobSchedulerPlan.Next(now.Add(-window).Add(-time.Nanosecond))
+		if missed = jobSchedulerPlan.collectTimes(start, now, maxRuns); len(missed) >= maxRuns {
+			return
+		}
+	}
+	return jobSchedulerPlan.collectTimes(from, now, maxRuns)
+}
+
+// 从first开始遍历到now为止的计划时间，保留最近的maxRuns个
+func (jobSchedulerPlan *JobSchedulerPlan) collectTimes(first time.Time, now time.Time, maxRuns int) (times []time.Time) {
+	for t := first; !t.IsZero() && !t.After(now); t = jobSchedulerPlan.Next(t) {
+		times = append(times, t)
+		if len(times) > maxRuns {
+			times = times[1:]
+		}
+	}
 	return
 }
 
+// 按任务的misfire策略计算需要补执行的计划时间，from是第一个错过的计划时间
+func (jobSchedulerPlan *JobSchedulerPlan) MisfireTimes(from time.Time, now time.Time) []time.Time {
+	switch jobSchedulerPlan.Job.MisfirePolicy {
+	case MISFIRE_POLICY_SKIP:
+		return nil
+	case MISFIRE_POLICY_RUN_ALL:
+		return jobSchedulerPlan.MissedTimes(from, now, jobSchedulerPlan.Job.GetMisfireMaxRuns())
+	default:
+		return jobSchedulerPlan.MissedTimes(from, now, 1)
+	}
+}
+
+// runAll策略最多补执行的次数
+func (job *Job) GetMisfireMaxRuns() int {
+	if job.MisfireMaxRuns <= 0 {
+		return MISFIRE_MAX_RUNS
+	}
+	return job.MisfireMaxRuns
+}
+
 // 构造任务执行状态
 func BuildJobExecuteInfo(jobSchedulerPlan *JobSchedulerPlan) (jobExecuteInfo *JobExecuteInfo) {
 	jobExecuteInfo = &JobExecuteInfo{
 		Job:      jobSchedulerPlan.Job,
+		RunId:    BuildRunId(),
 		PlanTime: jobSchedulerPlan.NextTime,
 		RealTime: time.Now(), // 真实调度时间
 	}
@@ -158,3 +939,98 @@ func BuildJobExecuteInfo(jobSchedulerPlan *JobSchedulerPlan) (jobExecuteInfo *Jo
 
 	return
 }
+
+// 构造手动触发的任务执行状态，计划时间取触发时间，各个worker一致
+func BuildTriggerExecuteInfo(trigger *JobTrigger) (jobExecuteInfo *JobExecuteInfo) {
+	jobExecuteInfo = &JobExecuteInfo{
+		Job:      trigger.Job,
+		RunId:    trigger.TriggerId,
+		PlanTime: time.Unix(0, trigger.TriggerTime*1e6),
+		RealTime: time.Now(),
+		Trigger:  trigger,
+
+		ShardIndex: trigger.ShardIndex,
+		ShardTotal: trigger.ShardTotal,
+	}
+
+	jobExecuteInfo.CommandCtx, jobExecuteInfo.CancelFunc = context.WithCancel(context.Background())
+
+	return
+}
+
+// 构造leader分派的任务执行状态，执行ID和计划时间由leader决定
+func BuildAssignExecuteInfo(assignment *JobAssignment) (jobExecuteInfo *JobExecuteInfo) {
+	jobExecuteInfo = &JobExecuteInfo{
+		Job:        assignment.Job,
+		RunId:      assignment.RunId,
+		PlanTime:   time.Unix(0, assignment.PlanTime*1e6),
+		RealTime:   time.Now(),
+		IsMisfire:  assignment.IsMisfire,
+		ShardIndex: assignment.ShardIndex,
+		ShardTotal: assignment.ShardTotal,
+		IsAssigned: true,
+	}
+
+	jobExecuteInfo.CommandCtx, jobExecuteInfo.CancelFunc = context.WithCancel(context.Background())
+
+	return
+}
+
+// 记录强杀请求并取消执行，可以多次调用
+func (jobExecuteInfo *JobExecuteInfo) Kill(killer *JobKiller) {
+	jobExecuteInfo.killerLock.Lock()
+	jobExecuteInfo.killers = append(jobExecuteInfo.killers, killer)
+	jobExecuteInfo.killerLock.Unlock()
+
+	jobExecuteInfo.CancelFunc()
+}
+
+// 收到的强杀请求
+func (jobExecuteInfo *JobExecuteInfo) GetKillers() []*JobKiller {
+	jobExecuteInfo.killerLock.Lock()
+	defer jobExecuteInfo.killerLock.Unlock()
+
+	return append([]*JobKiller(nil), jobExecuteInfo.killers...)
+}
+
+// 是否只是被Replace策略的新执行替换，用户同时强杀时按用户强杀记录
+func (jobExecuteInfo *JobExecuteInfo) IsReplaced() bool {
+	killers := jobExecuteInfo.GetKillers()
+	for _, killer := range killers {
+		if killer.Reason != JOB_KILL_REASON_REPLACE {
+			return false
+		}
+	}
+	return len(killers) != 0
+}
+
+// 是否为分片执行
+func (jobExecuteInfo *JobExecuteInfo) IsSharded() bool {
+	return jobExecuteInfo.ShardTotal > 1
+}
+
+// 水位线的名称，分片任务每个分片单独记录
+func (jobExecuteInfo *JobExecuteInfo) GetWatermarkName() string {
+	if jobExecuteInfo.IsSharded() {
+		return BuildShardName(jobExecuteInfo.Job.Name, jobExecuteInfo.ShardIndex)
+	}
+	return jobExecuteInfo.Job.Name
+}
+
+// 是否推进水位线：只有cron调度的成功执行，失败的执行留给补执行；水位线是集群共享的，广播任务不使用
+func (result *JobExecuteResult) AdvancesWatermark() bool {
+	info := result.ExecuteInfo
+	return result.Err == nil && info.Trigger == nil && !info.Job.IsBroadcast()
+}
+
+// 执行的触发方式
+func (jobExecuteInfo *JobExecuteInfo) GetTriggerType() string {
+	switch {
+	case jobExecuteInfo.Trigger == nil:
+		return JOB_TRIGGER_CRON
+	case jobExecuteInfo.Trigger.WorkflowRunId != "":
+		return JOB_TRIGGER_WORKFLOW
+	default:
+		return JOB_TRIGGER_MANUAL
+	}
+}
@@ -0,0 +1,325 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"固定间隔", RetryPolicy{Interval: 3}, 5, 3 * time.Second},
+		{"指数退避首次", RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 2}, 1, 2 * time.Second},
+		{"指数退避第三次", RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 2}, 3, 8 * time.Second},
+		{"指数退避受maxInterval限制", RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 2, MaxInterval: 10}, 5, 10 * time.Second},
+		{"未配置maxInterval时不溢出", RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 1}, 200, RETRY_MAX_BACKOFF},
+		{"maxInterval大于硬上限", RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 1, MaxInterval: 1 << 30}, 100, RETRY_MAX_BACKOFF},
+		{"固定间隔超过硬上限", RetryPolicy{Interval: 1 << 30}, 1, RETRY_MAX_BACKOFF},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.GetBackoff(test.attempt); got != test.want {
+			t.Errorf("%v: GetBackoff(%v) = %v, want %v", test.name, test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestGetBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 10, Jitter: 0.5}
+
+	for attempt := 1; attempt < 100; attempt++ {
+		base := (&RetryPolicy{Backoff: policy.Backoff, Interval: policy.Interval}).GetBackoff(attempt)
+		got := policy.GetBackoff(attempt)
+		if got < base/2 || got > base+base/2 {
+			t.Fatalf("GetBackoff(%v) = %v, want within ±50%% of %v", attempt, got, base)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy *RetryPolicy
+		valid  bool
+	}{
+		{nil, true},
+		{&RetryPolicy{MaxAttempts: 3, Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 1, Jitter: 0.2}, true},
+		{&RetryPolicy{MaxAttempts: -1}, false},
+		{&RetryPolicy{Interval: -1}, false},
+		{&RetryPolicy{MaxInterval: -1}, false},
+		{&RetryPolicy{Jitter: 1.5}, false},
+		{&RetryPolicy{Backoff: "linear"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.policy.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", test.policy, err, test.valid)
+		}
+	}
+}
+
+func TestJobSchedulerPlanNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(value string) time.Time {
+		tm, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	// 2026-03-08 02:00 EST跳变到03:00 EDT，2026-11-01 02:00 EDT回拨到01:00 EST
+	tests := []struct {
+		name     string
+		cronExpr string
+		from     string
+		want     string
+	}{
+		{"跳变前正常调度", "* * * * *", "2026-03-08T06:58:30Z", "2026-03-08T06:59:00Z"},
+		{"跳过的时刻顺延到跳变时刻", "30 2 * * *", "2026-03-08T05:00:00Z", "2026-03-08T07:00:00Z"},
+		{"顺延后次日恢复正常", "30 2 * * *", "2026-03-08T07:00:00Z", "2026-03-09T06:30:00Z"},
+		{"每分钟任务跳变期间只执行一次", "* * * * *", "2026-03-08T06:59:30Z", "2026-03-08T07:00:00Z"},
+		{"跳变后继续每分钟", "* * * * *", "2026-03-08T07:00:00Z", "2026-03-08T07:01:00Z"},
+		{"回拨前第一次经过", "* * * * *", "2026-11-01T05:00:30Z", "2026-11-01T05:01:00Z"},
+		{"回拨后第二次经过重复时刻", "* * * * *", "2026-11-01T06:00:30Z", "2026-11-01T07:00:00Z"},
+		{"每秒任务回拨后第二次经过", "* * * * * * *", "2026-11-01T06:00:30Z", "2026-11-01T07:00:00Z"},
+		{"重复时刻在第一次出现时执行", "30 1 * * *", "2026-11-01T05:00:00Z", "2026-11-01T05:30:00Z"},
+		{"重复时刻只执行一次", "30 1 * * *", "2026-11-01T05:30:00Z", "2026-11-02T06:30:00Z"},
+		{"回拨当天其他时刻正常", "0 3 * * *", "2026-11-01T04:00:00Z", "2026-11-01T08:00:00Z"},
+	}
+
+	for _, test := range tests {
+		jobPlan, err := BuildJobSchedulerPlan(&Job{Name: "job", CronExpr: test.cronExpr, Timezone: "America/New_York"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobPlan.Location.String() != loc.String() {
+			t.Fatalf("location = %v, want %v", jobPlan.Location, loc)
+		}
+
+		if got := jobPlan.Next(utc(test.from)); !got.Equal(utc(test.want)) {
+			t.Errorf("%v: Next(%v) = %v, want %v", test.name, test.from, got.UTC(), test.want)
+		}
+	}
+}
+
+// 逐个遍历错过的计划时间，作为MissedTimes的对照
+func walkMissedTimes(jobPlan *JobSchedulerPlan, from time.Time, now time.Time, maxRuns int) (missed []time.Time) {
+	for t := from; !t.IsZero() && !t.After(now); t = jobPlan.Next(t) {
+		missed = append(missed, t)
+	}
+	if len(missed) > maxRuns {
+		missed = missed[len(missed)-maxRuns:]
+	}
+	return
+}
+
+func TestMissedTimes(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 34, 56, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		cronExpr string
+		downtime time.Duration
+		maxRuns  int
+	}{
+		{"每分钟停机一小时", "* * * * *", time.Hour, 10},
+		{"每分钟停机一小时只取一次", "* * * * *", time.Hour, 1},
+		{"每秒停机一天", "* * * * * * *", 24 * time.Hour, 5},
+		{"错过的次数少于上限", "*/15 * * * *", 40 * time.Minute, 10},
+		{"工作时间每分钟停机一周", "* 9-17 * * 1-5", 7 * 24 * time.Hour, 3},
+		{"每月一次停机一年", "0 0 1 * *", 365 * 24 * time.Hour, 4},
+	}
+
+	for _, test := range tests {
+		jobPlan, err := BuildJobSchedulerPlan(&Job{Name: "job", CronExpr: test.cronExpr, Timezone: "UTC"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := jobPlan.Next(now.Add(-test.downtime))
+
+		got := jobPlan.MissedTimes(from, now, test.maxRuns)
+		want := walkMissedTimes(jobPlan, from, now, test.maxRuns)
+		if len(got) != len(want) {
+			t.Fatalf("%v: MissedTimes = %v, want %v", test.name, got, want)
+		}
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Fatalf("%v: MissedTimes = %v, want %v", test.name, got, want)
+			}
+		}
+	}
+}
+
+func TestMissedTimesEmpty(t *testing.T) {
+	jobPlan, err := BuildJobSchedulerPlan(&Job{Name: "job", CronExpr: "* * * * *", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	if missed := jobPlan.MissedTimes(now.Add(time.Minute), now, 10); len(missed) != 0 {
+		t.Errorf("MissedTimes(from after now) = %v, want empty", missed)
+	}
+	if missed := jobPlan.MissedTimes(now.Add(-time.Hour), now, 0); len(missed) != 0 {
+		t.Errorf("MissedTimes(maxRuns 0) = %v, want empty", missed)
+	}
+}
+
+func TestMisfireTimes(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 30, 0, time.UTC)
+	from := time.Date(2026, 10, 18, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		policy  string
+		maxRuns int
+		want    int
+		last    time.Time
+	}{
+		{MISFIRE_POLICY_SKIP, 0, 0, time.Time{}},
+		{"", 0, 1, now.Truncate(time.Minute)},
+		{MISFIRE_POLICY_RUN_ONCE, 5, 1, now.Truncate(time.Minute)},
+		{MISFIRE_POLICY_RUN_ALL, 0, MISFIRE_MAX_RUNS, now.Truncate(time.Minute)},
+		{MISFIRE_POLICY_RUN_ALL, 3, 3, now.Truncate(time.Minute)},
+		{MISFIRE_POLICY_RUN_ALL, 100, 61, now.Truncate(time.Minute)},
+	}
+
+	for _, test := range tests {
+		job := &Job{Name: "job", CronExpr: "* * * * *", Timezone: "UTC", MisfirePolicy: test.policy, MisfireMaxRuns: test.maxRuns}
+		jobPlan, err := BuildJobSchedulerPlan(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		missed := jobPlan.MisfireTimes(from, now)
+		if len(missed) != test.want {
+			t.Errorf("policy %q maxRuns %v: got %v runs, want %v", test.policy, test.maxRuns, len(missed), test.want)
+			continue
+		}
+		if len(missed) != 0 && !missed[len(missed)-1].Equal(test.last) {
+			t.Errorf("policy %q maxRuns %v: last run %v, want %v", test.policy, test.maxRuns, missed[len(missed)-1], test.last)
+		}
+	}
+}
+
+func TestJobLockValue(t *testing.T) {
+	planTime := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	info := &JobExecuteInfo{RunId: "run1", PlanTime: planTime, Trigger: &JobTrigger{}}
+
+	lockValue := DecodeJobLockValue([]byte(BuildJobLockValue(info)))
+	if lockValue.RunId != "run1" || lockValue.PlanTime != planTime.UnixNano()/1e6 || lockValue.Trigger != JOB_TRIGGER_MANUAL {
+		t.Errorf("DecodeJobLockValue = %+v", lockValue)
+	}
+
+	// 旧版本的锁只记录执行ID
+	if lockValue = DecodeJobLockValue([]byte("run2")); lockValue.RunId != "run2" || lockValue.Trigger != JOB_TRIGGER_CRON {
+		t.Errorf("DecodeJobLockValue(legacy) = %+v", lockValue)
+	}
+}
+
+func TestJobExecuteInfoKill(t *testing.T) {
+	info := BuildJobExecuteInfo(&JobSchedulerPlan{Job: &Job{Name: "job"}})
+	if info.IsReplaced() {
+		t.Fatal("IsReplaced() = true before kill")
+	}
+
+	info.Kill(&JobKiller{Reason: JOB_KILL_REASON_REPLACE})
+	if info.CommandCtx.Err() == nil {
+		t.Fatal("Kill did not cancel the command")
+	}
+	if !info.IsReplaced() {
+		t.Error("IsReplaced() = false after replace kill")
+	}
+
+	// 用户同时强杀时按用户强杀记录
+	info.Kill(&JobKiller{KillId: "kill1"})
+	if info.IsReplaced() {
+		t.Error("IsReplaced() = true after user kill")
+	}
+	if killers := info.GetKillers(); len(killers) != 2 || killers[1].KillId != "kill1" {
+		t.Errorf("GetKillers() = %v", killers)
+	}
+}
+
+func TestAdvancesWatermark(t *testing.T) {
+	cronInfo := &JobExecuteInfo{Job: &Job{Name: "job"}}
+	cases := []struct {
+		name   string
+		result *JobExecuteResult
+		want   bool
+	}{
+		{"success", &JobExecuteResult{ExecuteInfo: cronInfo}, true},
+		{"failed", &JobExecuteResult{ExecuteInfo: cronInfo, Err: ERR_JOB_RETRY_CANCELED}, false},
+		{"trigger", &JobExecuteResult{ExecuteInfo: &JobExecuteInfo{Job: cronInfo.Job, Trigger: &JobTrigger{}}}, false},
+		{"broadcast", &JobExecuteResult{ExecuteInfo: &JobExecuteInfo{Job: &Job{Name: "job", ExecutionMode: EXECUTION_MODE_BROADCAST}}}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.result.AdvancesWatermark(); got != c.want {
+			t.Errorf("%v: AdvancesWatermark() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLabelRequirementMatches(t *testing.T) {
+	labels := map[string]string{"zone": "bj", "gpu": "true"}
+
+	tests := []struct {
+		requirement *LabelRequirement
+		want        bool
+	}{
+		{&LabelRequirement{Key: "zone", Operator: LABEL_OPERATOR_IN, Values: []string{"bj", "sh"}}, true},
+		{&LabelRequirement{Key: "zone", Operator: LABEL_OPERATOR_IN, Values: []string{"sh"}}, false},
+		{&LabelRequirement{Key: "disk", Operator: LABEL_OPERATOR_IN, Values: []string{"ssd"}}, false},
+		{&LabelRequirement{Key: "zone", Operator: LABEL_OPERATOR_NOT_IN, Values: []string{"bj"}}, false},
+		{&LabelRequirement{Key: "zone", Operator: LABEL_OPERATOR_NOT_IN, Values: []string{"sh"}}, true},
+		{&LabelRequirement{Key: "disk", Operator: LABEL_OPERATOR_NOT_IN, Values: []string{"ssd"}}, true},
+		{&LabelRequirement{Key: "gpu", Operator: LABEL_OPERATOR_EXISTS}, true},
+		{&LabelRequirement{Key: "disk", Operator: LABEL_OPERATOR_EXISTS}, false},
+		{&LabelRequirement{Key: "gpu", Operator: LABEL_OPERATOR_DOES_NOT_EXIST}, false},
+		{&LabelRequirement{Key: "disk", Operator: LABEL_OPERATOR_DOES_NOT_EXIST}, true},
+		{&LabelRequirement{Key: "zone", Operator: "Gt"}, false},
+		{nil, true},
+	}
+
+	for _, test := range tests {
+		if got := test.requirement.Matches(labels); got != test.want {
+			t.Errorf("%+v Matches(%v) = %v, want %v", test.requirement, labels, got, test.want)
+		}
+	}
+
+	// 包含null的nodeSelector不会panic，其余条件照常生效
+	job := &Job{NodeSelector: []*LabelRequirement{nil, {Key: "zone", Operator: LABEL_OPERATOR_IN, Values: []string{"sh"}}}}
+	if job.MatchLabels(labels) {
+		t.Error("MatchLabels with null entry ignored the other requirements")
+	}
+}
+
+func TestValidateNodeSelector(t *testing.T) {
+	tests := []struct {
+		nodeSelector []*LabelRequirement
+		valid        bool
+	}{
+		{nil, true},
+		{[]*LabelRequirement{{Key: "zone", Operator: LABEL_OPERATOR_IN, Values: []string{"bj"}}}, true},
+		{[]*LabelRequirement{{Key: "gpu", Operator: LABEL_OPERATOR_EXISTS}}, true},
+		{[]*LabelRequirement{nil}, false},
+		{[]*LabelRequirement{{Operator: LABEL_OPERATOR_EXISTS}}, false},
+		{[]*LabelRequirement{{Key: "zone", Operator: LABEL_OPERATOR_IN}}, false},
+		{[]*LabelRequirement{{Key: "gpu", Operator: LABEL_OPERATOR_EXISTS, Values: []string{"true"}}}, false},
+		{[]*LabelRequirement{{Key: "zone", Operator: "Gt", Values: []string{"1"}}}, false},
+	}
+
+	for _, test := range tests {
+		job := &Job{NodeSelector: test.nodeSelector}
+		if err := job.ValidateNodeSelector(); (err == nil) != test.valid {
+			t.Errorf("ValidateNodeSelector(%v) = %v, want valid %v", test.nodeSelector, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package common
+
+import (
+	"encoding/json"
+	"github.com/gorhill/cronexpr"
+	"strings"
+	"time"
+)
+
+// 工作流，保存在/cron/workflows/工作流名
+type Workflow struct {
+	Name     string          `json:"name"`
+	CronExpr string          `json:"cronExpr"` // 工作流的cron表达式，为空只能手动启动
+	Timezone string          `json:"timezone"` // cron表达式所在时区
+	Nodes    []*WorkflowNode `json:"nodes"`    // 工作流节点，每个节点是一个任务
+}
+
+// 工作流节点
+type WorkflowNode struct {
+	JobName string            `json:"jobName"` // 节点执行的任务
+	Depends []*WorkflowDepend `json:"depends"` // 上游依赖，为空表示起始节点
+}
+
+// 节点对上游的依赖
+type WorkflowDepend struct {
+	JobName   string `json:"jobName"`   // 上游节点的任务名
+	Condition string `json:"condition"` // 触发条件 success failure always，默认success
+}
+
+// 工作流的一次运行，保存在/cron/workflow_runs/工作流名/运行ID
+type WorkflowRun struct {
+	RunId     string                      `json:"runId"`
+	Workflow  *Workflow                   `json:"workflow"`  // 启动时的工作流定义
+	Status    string                      `json:"status"`    // running success failed
+	StartTime int64                       `json:"startTime"` // 启动时间，单位毫秒
+	EndTime   int64                       `json:"endTime"`   // 结束时间，单位毫秒
+	Nodes     map[string]*WorkflowNodeRun `json:"nodes"`     // 各节点的状态 key:value = jobName:nodeRun
+}
+
+// 节点的运行状态
+type WorkflowNodeRun struct {
+	Status    string `json:"status"`    // pending running success failed skipped
+	RunId     string `json:"runId"`     // 节点任务的执行ID，可用于查询日志
+	StartTime int64  `json:"startTime"` // 开始时间，单位毫秒
+	EndTime   int64  `json:"endTime"`   // 结束时间，单位毫秒
+}
+
+// 反序列化workflow
+func UnpackWorkflow(value []byte) (ret *Workflow, err error) {
+	var workflow Workflow
+	if err = json.Unmarshal(value, &workflow); err != nil {
+		return
+	}
+
+	ret = &workflow
+	return
+}
+
+// 反序列化workflow run
+func UnpackWorkflowRun(value []byte) (ret *WorkflowRun, err error) {
+	var run WorkflowRun
+	if err = json.Unmarshal(value, &run); err != nil {
+		return
+	}
+
+	ret = &run
+	return
+}
+
+// 从etcd的key中提取工作流名称
+func ExtractWorkflowName(key string) (workflowName string) {
+	return strings.TrimPrefix(key, WORKFLOW_SAVE_DIR)
+}
+
+// 工作流运行记录的路径
+func BuildWorkflowRunKey(workflowName string, runId string) string {
+	return WORKFLOW_RUN_DIR + workflowName + "/" + runId
+}
+
+// 工作流转换成调度计划，复用任务的调度堆
+func BuildWorkflowSchedulerPlan(workflow *Workflow) (jobSchedulerPlan *JobSchedulerPlan, err error) {
+	job := &Job{
+		Name:     workflow.Name,
+		CronExpr: workflow.CronExpr,
+		Timezone: workflow.Timezone,
+	}
+
+	if jobSchedulerPlan, err = BuildJobSchedulerPlan(job); err != nil {
+		return
+	}
+	jobSchedulerPlan.Workflow = workflow
+	return
+}
+
+// 校验工作流：节点不重复、依赖的节点存在、条件合法、没有环
+func (workflow *Workflow) Validate() (err error) {
+	if workflow.Name == "" || len(workflow.Nodes) == 0 {
+		return ERR_INVALID_WORKFLOW
+	}
+
+	if workflow.CronExpr != "" {
+		if _, err = cronexpr.Parse(workflow.CronExpr); err != nil {
+			return
+		}
+	}
+	if _, err = (&Job{Timezone: workflow.Timezone}).GetLocation(); err != nil {
+		return
+	}
+
+	nodes := make(map[string]*WorkflowNode)
+	for _, node := range workflow.Nodes {
+		if node.JobName == "" {
+			return ERR_INVALID_WORKFLOW
+		}
+		if _, ok := nodes[node.JobName]; ok {
+			return ERR_INVALID_WORKFLOW
+		}
+		nodes[node.JobName] = node
+	}
+
+	for _, node := range workflow.Nodes {
+		for _, depend := range node.Depends {
+			if _, ok := nodes[depend.JobName]; !ok {
+				return ERR_INVALID_WORKFLOW
+			}
+			switch depend.Condition {
+			case "", WORKFLOW_CONDITION_SUCCESS, WORKFLOW_CONDITION_FAILURE, WORKFLOW_CONDITION_ALWAYS:
+			default:
+				return ERR_INVALID_WORKFLOW
+			}
+		}
+	}
+
+	// 拓扑排序检测环
+	inDegree := make(map[string]int)
+	downstream := make(map[string][]string)
+	for _, node := range workflow.Nodes {
+		inDegree[node.JobName] += 0
+		for _, depend := range node.Depends {
+			inDegree[node.JobName]++
+			downstream[depend.JobName] = append(downstream[depend.JobName], node.JobName)
+		}
+	}
+
+	queue := make([]string, 0)
+	for name, degree := range inDegree {
+		if degree == 0 {
+			queue = append(queue, name)
+		}
+	}
+	visited := 0
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, next := range downstream[name] {
+			if inDegree[next]--; inDegree[next] == 0 {
+				queue = append(queue, next)
+			}
+		}
+	}
+	if visited != len(workflow.Nodes) {
+		return ERR_WORKFLOW_CYCLE
+	}
+
+	return
+}
+
+// 构造工作流的一次运行，所有节点等待执行
+func BuildWorkflowRun(workflow *Workflow, runId string) (run *WorkflowRun) {
+	run = &WorkflowRun{
+		RunId:     runId,
+		Workflow:  workflow,
+		Status:    WORKFLOW_STATUS_RUNNING,
+		StartTime: time.Now().UnixNano() / 1e6,
+		Nodes:     make(map[string]*WorkflowNodeRun),
+	}
+
+	for _, node := range workflow.Nodes {
+		run.Nodes[node.JobName] = &WorkflowNodeRun{Status: WORKFLOW_STATUS_PENDING}
+	}
+	return
+}
+
+// 节点是否已经结束
+func isNodeFinished(status string) bool {
+	return status == WORKFLOW_STATUS_SUCCESS || status == WORKFLOW_STATUS_FAILED || status == WORKFLOW_STATUS_SKIPPED
+}
+
+// 上游节点的结果是否满足依赖条件
+func isDependSatisfied(depend *WorkflowDepend, status string) bool {
+	switch depend.Condition {
+	case WORKFLOW_CONDITION_ALWAYS:
+		return true
+	case WORKFLOW_CONDITION_FAILURE:
+		return status == WORKFLOW_STATUS_FAILED
+	default:
+		return status == WORKFLOW_STATUS_SUCCESS
+	}
+}
+
+// 记录节点的执行结果
+func (run *WorkflowRun) FinishNode(jobName string, status string) {
+	if nodeRun, ok := run.Nodes[jobName]; ok {
+		nodeRun.Status = status
+		nodeRun.EndTime = time.Now().UnixNano() / 1e6
+	}
+}
+
+// 推进工作流：上游全部结束后，满足条件的节点可以启动，不满足条件的节点跳过
+// 返回可以启动的节点，全部节点结束时计算工作流的结果
+func (run *WorkflowRun) Advance() (ready []string) {
+	// 跳过的节点会影响下游，循环直到没有变化
+	for changed := true; changed; {
+		changed = false
+		ready = ready[:0]
+
+		for _, node := range run.Workflow.Nodes {
+			nodeRun := run.Nodes[node.JobName]
+			if nodeRun.Status != WORKFLOW_STATUS_PENDING {
+				continue
+			}
+
+			finished, satisfied := true, true
+			for _, depend := range node.Depends {
+				status := run.Nodes[depend.JobName].Status
+				if !isNodeFinished(status) {
+					finished = false
+					break
+				}
+				if !isDependSatisfied(depend, status) {
+					satisfied = false
+				}
+			}
+
+			switch {
+			case !finished:
+			case satisfied:
+				ready = append(ready, node.JobName)
+			default:
+				nodeRun.Status = WORKFLOW_STATUS_SKIPPED
+				changed = true
+			}
+		}
+	}
+
+	// 全部节点结束，有失败的节点则工作流失败
+	status := WORKFLOW_STATUS_SUCCESS
+	for _, nodeRun := range run.Nodes {
+		if !isNodeFinished(nodeRun.Status) {
+			return
+		}
+		if nodeRun.Status == WORKFLOW_STATUS_FAILED {
+			status = WORKFLOW_STATUS_FAILED
+		}
+	}
+	run.Status = status
+	run.EndTime = time.Now().UnixNano() / 1e6
+	return
+}
+
+// 标记节点开始执行，runId为节点任务的执行ID
+func (run *WorkflowRun) StartNode(jobName string, runId string) {
+	if nodeRun, ok := run.Nodes[jobName]; ok {
+		nodeRun.Status = WORKFLOW_STATUS_RUNNING
+		nodeRun.RunId = runId
+		nodeRun.StartTime = time.Now().UnixNano() / 1e6
+	}
+}
+
+// 节点通过手动触发启动，触发ID即节点的执行ID
+// 节点不分片，分片任务作为工作流节点时整体执行一次
+func (run *WorkflowRun) BuildNodeTrigger(jobName string, job *Job) *JobTrigger {
+	return &JobTrigger{
+		TriggerId:     run.Nodes[jobName].RunId,
+		Job:           job,
+		TriggerTime:   time.Now().UnixNano() / 1e6,
+		WorkflowName:  run.Workflow.Name,
+		WorkflowRunId: run.RunId,
+	}
+}
+
+// 节点是否已经不会再结束，status为nil表示触发状态已经不存在，running表示集群中有这次执行的记录
+// deadline之后更新过的状态都还在有效期内：触发请求等待认领、执行结果等待上报
+func IsWorkflowNodeStuck(status *JobTriggerStatus, running bool, deadline int64) bool {
+	if status == nil {
+		return true
+	}
+
+	switch status.Status {
+	case TRIGGER_STATUS_PENDING, TRIGGER_STATUS_EXPIRED, TRIGGER_STATUS_CANCELED:
+		// 超过有效期仍是pending，说明触发请求已经过期删除
+		return true
+	case TRIGGER_STATUS_DONE:
+		// 执行已经结束，但是结果没有推进到运行记录(worker在上报前退出)
+		return status.UpdateTime < deadline
+	case TRIGGER_STATUS_RUNNING:
+		// 执行的worker宕机，执行记录随租约过期；重试退避期间没有执行记录，等到重试时间之后再判断
+		return !running && status.UpdateTime < deadline && status.RetryTime < deadline
+	case TRIGGER_STATUS_BROADCAST:
+		// 广播节点不被认领，节点启动超过deadline仍没有worker在执行，说明没有匹配的worker或者都已经退出
+		return !running
+	}
+	return false
+}
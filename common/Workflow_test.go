@@ -0,0 +1,33 @@
+package common
+
+import "testing"
+
+func TestIsWorkflowNodeStuck(t *testing.T) {
+	const deadline = 1000
+
+	cases := []struct {
+		name    string
+		status  *JobTriggerStatus
+		running bool
+		want    bool
+	}{
+		{"missing", nil, false, true},
+		{"pending", &JobTriggerStatus{Status: TRIGGER_STATUS_PENDING, UpdateTime: 500}, false, true},
+		{"claimed", &JobTriggerStatus{Status: TRIGGER_STATUS_CLAIMED, UpdateTime: 500}, false, false},
+		{"done recently", &JobTriggerStatus{Status: TRIGGER_STATUS_DONE, UpdateTime: 1500}, false, false},
+		{"done long ago", &JobTriggerStatus{Status: TRIGGER_STATUS_DONE, UpdateTime: 500}, false, true},
+		{"running", &JobTriggerStatus{Status: TRIGGER_STATUS_RUNNING, UpdateTime: 500}, true, false},
+		{"running worker gone", &JobTriggerStatus{Status: TRIGGER_STATUS_RUNNING, UpdateTime: 500}, false, true},
+		{"running just started", &JobTriggerStatus{Status: TRIGGER_STATUS_RUNNING, UpdateTime: 1500}, false, false},
+		{"waiting for retry", &JobTriggerStatus{Status: TRIGGER_STATUS_RUNNING, UpdateTime: 500, RetryTime: 1500}, false, false},
+		{"retry never started", &JobTriggerStatus{Status: TRIGGER_STATUS_RUNNING, UpdateTime: 500, RetryTime: 800}, false, true},
+		{"broadcast running", &JobTriggerStatus{Status: TRIGGER_STATUS_BROADCAST, UpdateTime: 500}, true, false},
+		{"broadcast no worker", &JobTriggerStatus{Status: TRIGGER_STATUS_BROADCAST, UpdateTime: 500}, false, true},
+	}
+
+	for _, c := range cases {
+		if got := IsWorkflowNodeStuck(c.status, c.running, deadline); got != c.want {
+			t.Errorf("%v: IsWorkflowNodeStuck() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
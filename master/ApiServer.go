@@ -2,7 +2,9 @@ package master
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/MrDragon1122/crontab/common"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -28,6 +30,7 @@ func handleJobSave(resp http.ResponseWriter, req *http.Request) {
 		postJob string
 		job     common.Job
 		oldJob  common.Job
+		msg     string
 		bytes   []byte
 	)
 
@@ -52,8 +55,15 @@ func handleJobSave(resp http.ResponseWriter, req *http.Request) {
 
 	log.Infof("save job %v success", job)
 
+	// 没有在线的worker满足nodeSelector时提示，任务仍然保存，等待匹配的worker上线
+	msg = "success"
+	if matched, e := G_workerMgr.HasMatchingWorker(&job); e == nil && !matched {
+		log.Warnf("job %v matches no live worker", job.Name)
+		msg = "success, warning: no live worker matches the nodeSelector"
+	}
+
 	// 5、返回正常应答({"error":0, "msg":"", "data":{...}})
-	if bytes, err = common.BuildResponse(0, "success", oldJob); err == nil {
+	if bytes, err = common.BuildResponse(0, msg, oldJob); err == nil {
 		resp.Write(bytes)
 	}
 
@@ -140,33 +150,183 @@ ERR:
 
 // 杀死任务 利用etcd的watch功能实现，通知机制
 func handlerJobKill(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err        error
+		jobName    string
+		runId      string
+		killId     string
+		waitTime   time.Duration
+		killResult *common.KillResult
+		bytes      []byte
+	)
+	// 获取表单
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	jobName = req.PostForm.Get("name")
+	runId = req.PostForm.Get("runId") // 可选，只杀死指定的执行
+
+	// 发出强杀请求
+	if killId, waitTime, err = G_jobMgr.KillJob(jobName, runId); err != nil {
+		goto ERR
+	}
+
+	// 等待worker确认，超时未确认的worker在pending中，之后仍可通过/job/kill/status查询
+	if killResult, err = G_jobMgr.WaitKillResult(killId, waitTime); err != nil {
+		goto ERR
+	}
+
+	log.Infof("kill job %v success, killId: %v, acks: %v, pending: %v", jobName, killId, len(killResult.Acks), killResult.Pending)
+
+	if bytes, err = common.BuildResponse(0, "success", killResult); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+
+ERR:
+	log.Errorf("handle kill job err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+}
+
+// 查询强杀请求的确认
+// GET /job/kill/status?killId=xxx
+func handleJobKillStatus(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err        error
+		killResult *common.KillResult
+		bytes      []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	if killResult, err = G_jobMgr.GetKillResult(req.Form.Get("killId")); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", killResult); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle job kill status err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+}
+
+// 暂停任务
+// name=job1
+func handleJobPause(resp http.ResponseWriter, req *http.Request) {
+	handleJobSetPaused(resp, req, true)
+}
+
+// 恢复任务
+// name=job1
+func handleJobResume(resp http.ResponseWriter, req *http.Request) {
+	handleJobSetPaused(resp, req, false)
+}
+
+// 修改任务的暂停状态
+func handleJobSetPaused(resp http.ResponseWriter, req *http.Request, paused bool) {
 	var (
 		err     error
 		jobName string
+		job     common.Job
 		bytes   []byte
 	)
-	// 获取表单
+
 	if err = req.ParseForm(); err != nil {
 		goto ERR
 	}
 
 	jobName = req.PostForm.Get("name")
 
-	// 杀死任务
-	if err = G_jobMgr.KillJob(jobName); err != nil {
+	if job, err = G_jobMgr.SetJobPaused(jobName, paused); err != nil {
 		goto ERR
 	}
 
-	log.Infof("kill job %v success", jobName)
+	log.Infof("set job %v paused=%v success", jobName, paused)
 
-	if bytes, err = common.BuildResponse(0, "success", nil); err == nil {
+	if bytes, err = common.BuildResponse(0, "success", job); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+
+ERR:
+	log.Errorf("handle set job paused err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+}
+
+// 立即执行任务，可以覆盖环境变量和追加命令参数
+// name=job1&env={"KEY":"value"}&args=["a","b"]
+func handleJobRun(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		jobName  string
+		env      map[string]string
+		args     []string
+		triggers []*common.JobTrigger
+		bytes    []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	jobName = req.PostForm.Get("name")
+
+	// 可选的环境变量和参数
+	if postEnv := req.PostForm.Get("env"); postEnv != "" {
+		if err = json.Unmarshal([]byte(postEnv), &env); err != nil {
+			goto ERR
+		}
+	}
+	if postArgs := req.PostForm.Get("args"); postArgs != "" {
+		if err = json.Unmarshal([]byte(postArgs), &args); err != nil {
+			goto ERR
+		}
+	}
+
+	if triggers, err = G_jobMgr.TriggerJob(jobName, env, args); err != nil {
+		goto ERR
+	}
+
+	log.Infof("trigger job %v success, triggers: %v", jobName, len(triggers))
+
+	// 返回触发ID，即本次执行ID，可用于跟踪输出和通过/job/run/status查询是否执行；分片任务返回每个分片的触发请求
+	if len(triggers) == 1 {
+		bytes, err = common.BuildResponse(0, "success", triggers[0])
+	} else {
+		bytes, err = common.BuildResponse(0, "success", triggers)
+	}
+	if err == nil {
 		resp.Write(bytes)
 	}
 
 	return
 
 ERR:
-	log.Error("handle kill job err: %v", err)
+	log.Errorf("handle job run err: %v", err)
+
+	// 非法的环境变量名是请求错误
+	if err == common.ERR_INVALID_ENV {
+		resp.WriteHeader(http.StatusBadRequest)
+	}
 	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
 		resp.Write(bytes)
 	}
@@ -174,6 +334,66 @@ ERR:
 	return
 }
 
+// 查询手动触发请求的状态，确认触发是否被执行
+// GET /job/run/status?name=job1&triggerId=xxx
+func handleJobRunStatus(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		status *common.JobTriggerStatus
+		bytes  []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	if status, err = G_jobMgr.GetTriggerStatus(req.Form.Get("name"), req.Form.Get("triggerId")); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", status); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle job run status err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+}
+
+// 查询集群中正在执行的任务
+// GET /job/running?name=job1，name为空返回所有任务
+func handleJobRunning(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err         error
+		runningJobs []*common.RunningJob
+		bytes       []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	if runningJobs, err = G_jobMgr.ListRunning(req.Form.Get("name")); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", runningJobs); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle job running err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+}
+
 // 查询日志
 func handlerJobLog(resp http.ResponseWriter, req *http.Request) {
 	var (
@@ -214,11 +434,348 @@ func handlerJobLog(resp http.ResponseWriter, req *http.Request) {
 	return
 
 ERR:
-	log.Error("handle job log err: %v", err)
+	log.Errorf("handle job log err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+}
+
+// 查询广播、分片任务各次调度在每个worker或每个分片上的结果
+// GET /job/log/runs?name=job1&skip=0&limit=10  skip limit按调度次数翻页
+func handlerJobLogRuns(resp http.ResponseWriter, req *http.Request) {
+	var (
+		bytes []byte
+	)
+
+	// 解析表单
+	if err := req.ParseForm(); err != nil {
+		return
+	}
+
+	name := req.Form.Get("name")
+
+	// 转化为数字
+	skip, err := strconv.Atoi(req.Form.Get("skip"))
+	if err != nil {
+		skip = 0
+	}
+	limit, err := strconv.Atoi(req.Form.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	if skip < 0 {
+		skip = 0
+	}
+
+	runArr, err := G_logMgr.ListRunGroups(name, skip, limit)
+	if err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", runArr); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle job log runs err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+}
+
+// 实时跟踪任务输出(Server-Sent Events)
+// /job/log/tail?name=job1&runId=xxx  runId为空时跟踪最近一次执行
+func handlerJobLogTail(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err      error
+		name     string
+		runId    string
+		seq      int64
+		chunkArr []*common.JobLogChunk
+		flusher  http.Flusher
+		ok       bool
+		bytes    []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	name = req.Form.Get("name")
+	runId = req.Form.Get("runId")
+
+	// 断线重连时从最后收到的分片之后继续推送
+	if lastEventId := req.Header.Get("Last-Event-ID"); lastEventId != "" {
+		if seq, err = strconv.ParseInt(lastEventId, 10, 64); err != nil {
+			goto ERR
+		}
+	}
+
+	if flusher, ok = resp.(http.Flusher); !ok {
+		err = common.ERR_STREAM_NOT_SUPPORTED
+		goto ERR
+	}
+
+	if runId == "" {
+		if runId, err = G_logMgr.GetLatestRunId(name); err != nil {
+			goto ERR
+		}
+	}
+
+	// 长连接不受写超时限制
+	http.NewResponseController(resp).SetWriteDeadline(time.Time{})
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	log.Infof("tail job %v log, runId: %v", name, runId)
+
+	for {
+		if chunkArr, err = G_logMgr.ListLogChunk(runId, seq, 100); err != nil {
+			log.Errorf("tail job %v log err: %v", name, err)
+			return
+		}
+
+		// 每个分片作为一个事件推送，事件类型为输出流，事件ID为分片序号
+		for _, chunk := range chunkArr {
+			if bytes, err = json.Marshal(chunk); err != nil {
+				continue
+			}
+			fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", chunk.Seq, chunk.Stream, bytes)
+			seq = chunk.Seq
+
+			// 命令已结束
+			if chunk.Stream == common.LOG_STREAM_END {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done(): // 客户端断开
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+ERR:
+	log.Errorf("handle job log tail err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+}
+
+// 下载某次执行保存在GridFS中的完整输出，需要worker开启outputSpill
+// /job/log/output?runId=xxx
+func handlerJobLogOutput(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err    error
+		runId  string
+		stream io.ReadCloser
+		bytes  []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	runId = req.Form.Get("runId")
+
+	if stream, err = G_logMgr.OpenOutputSpill(runId); err != nil {
+		goto ERR
+	}
+	defer stream.Close()
+
+	// 完整输出可能很大，不受写超时限制
+	http.NewResponseController(resp).SetWriteDeadline(time.Time{})
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if _, err = io.Copy(resp, stream); err != nil {
+		log.Errorf("read job output %v err: %v", runId, err)
+		return
+	}
+
+	log.Infof("job output %v success", runId)
+	return
+
+ERR:
+	log.Errorf("handle job log output err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+}
+
+// 保存工作流
+// Post workflow = {"name":"wf1", "cronExpr":"0 0 * * * * *", "nodes":[{"jobName":"job1"}, {"jobName":"job2", "depends":[{"jobName":"job1", "condition":"success"}]}]}
+func handleWorkflowSave(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err          error
+		postWorkflow string
+		workflow     common.Workflow
+		bytes        []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	postWorkflow = req.PostForm.Get("workflow")
+	if err = json.Unmarshal([]byte(postWorkflow), &workflow); err != nil {
+		goto ERR
+	}
+
+	if err = G_workflowMgr.SaveWorkflow(&workflow); err != nil {
+		goto ERR
+	}
+
+	log.Infof("save workflow %v success", workflow.Name)
+
+	if bytes, err = common.BuildResponse(0, "success", workflow); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle workflow save err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+}
+
+// 删除工作流
+// name = wf1
+func handleWorkflowDel(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err   error
+		name  string
+		bytes []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	name = req.PostForm.Get("name")
+	if err = G_workflowMgr.DelWorkflow(name); err != nil {
+		goto ERR
+	}
+
+	log.Infof("del workflow %v success", name)
+
+	if bytes, err = common.BuildResponse(0, "success", nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle workflow del err: %v", err)
 	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
 		resp.Write(bytes)
 	}
+	return
+}
+
+// 获取所有的工作流
+func handleWorkflowList(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		workflows []*common.Workflow
+		bytes     []byte
+	)
+
+	if workflows, err = G_workflowMgr.ListWorkflows(); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", workflows); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle workflow list err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+}
+
+// 手动启动工作流
+// name = wf1
+func handleWorkflowRun(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err   error
+		name  string
+		run   *common.WorkflowRun
+		bytes []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	name = req.PostForm.Get("name")
+	if run, err = G_workflowMgr.StartWorkflowRun(name); err != nil {
+		goto ERR
+	}
+
+	log.Infof("start workflow %v success, run: %v", name, run.RunId)
+
+	// 返回运行记录，包含起始节点的执行ID
+	if bytes, err = common.BuildResponse(0, "success", run); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle workflow run err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+}
+
+// 查询工作流的运行记录及各节点状态
+// GET /workflow/runs?name=wf1
+func handleWorkflowRuns(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err   error
+		runs  []*common.WorkflowRun
+		bytes []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	if runs, err = G_workflowMgr.ListWorkflowRuns(req.Form.Get("name")); err != nil {
+		goto ERR
+	}
 
+	if bytes, err = common.BuildResponse(0, "success", runs); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle workflow runs err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
 	return
 }
 
@@ -241,7 +798,47 @@ func handleWorkerList(resp http.ResponseWriter, req *http.Request) {
 	return
 
 ERR:
-	log.Error("handle get worker list err: %v", err)
+	log.Errorf("handle get worker list err: %v", err)
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+
+	return
+}
+
+// 请求worker下线
+// POST ip=192.168.1.1&timeout=60  timeout为等待正在执行的任务结束的秒数，为空使用worker的配置
+func handleWorkerDrain(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err     error
+		ip      string
+		timeout int
+		bytes   []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+
+	ip = req.PostForm.Get("ip")
+	if postTimeout := req.PostForm.Get("timeout"); postTimeout != "" {
+		if timeout, err = strconv.Atoi(postTimeout); err != nil {
+			goto ERR
+		}
+	}
+
+	if err = G_workerMgr.DrainWorker(ip, timeout); err != nil {
+		goto ERR
+	}
+
+	log.Infof("drain worker %v requested", ip)
+	if bytes, err = common.BuildResponse(0, "success", nil); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	log.Errorf("handle worker drain err: %v", err)
 	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
 		resp.Write(bytes)
 	}
@@ -257,8 +854,24 @@ func InitApiServer() (err error) {
 	mux.HandleFunc("/job/delete", handleJobDel)
 	mux.HandleFunc("/job/list", handleJobList)
 	mux.HandleFunc("/job/kill", handlerJobKill)
+	mux.HandleFunc("/job/kill/status", handleJobKillStatus)
+	mux.HandleFunc("/job/pause", handleJobPause)
+	mux.HandleFunc("/job/resume", handleJobResume)
+	mux.HandleFunc("/job/run", handleJobRun)
+	mux.HandleFunc("/job/run/status", handleJobRunStatus)
+	mux.HandleFunc("/job/running", handleJobRunning)
 	mux.HandleFunc("/job/log", handlerJobLog)
+	mux.HandleFunc("/job/log/tail", handlerJobLogTail)
+	mux.HandleFunc("/job/log/runs", handlerJobLogRuns)
+	mux.HandleFunc("/job/log/broadcast", handlerJobLogRuns) // 兼容旧的广播结果接口
+	mux.HandleFunc("/job/log/output", handlerJobLogOutput)
+	mux.HandleFunc("/workflow/save", handleWorkflowSave)
+	mux.HandleFunc("/workflow/delete", handleWorkflowDel)
+	mux.HandleFunc("/workflow/list", handleWorkflowList)
+	mux.HandleFunc("/workflow/run", handleWorkflowRun)
+	mux.HandleFunc("/workflow/runs", handleWorkflowRuns)
 	mux.HandleFunc("/worker/list", handleWorkerList)
+	mux.HandleFunc("/worker/drain", handleWorkerDrain)
 
 	// 知识点：路由匹配时支持最大路由匹配原则
 
@@ -0,0 +1,25 @@
+package master
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandleJobRunInvalidEnv(t *testing.T) {
+	G_jobMgr = &JobMgr{}
+
+	for _, env := range []string{`{"BAD-NAME":"1"}`, `{"CRON_JOB_NAME":"1"}`} {
+		form := url.Values{"name": {"job"}, "env": {env}}
+		req := httptest.NewRequest(http.MethodPost, "/job/run", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp := httptest.NewRecorder()
+
+		handleJobRun(resp, req)
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("env %v: status = %v, want %v", env, resp.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -5,6 +5,10 @@ import (
 	"github.com/MrDragon1122/crontab/common"
 	"github.com/coreos/etcd/clientv3"
 	"golang.org/x/net/context"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -19,6 +23,9 @@ var (
 	G_jobMgr *JobMgr
 )
 
+// 合法的环境变量名
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 func InitJobMgr() (err error) {
 	// 初始化配置
 	config := clientv3.Config{
@@ -52,27 +59,134 @@ func (jobMgr *JobMgr) SaveJob(job *common.Job) (oldJob common.Job, err error) {
 	// 定义etcd的key ： value
 	jobKey := common.JOB_SAVE_DIR + job.Name
 
-	jobValue, err := json.Marshal(job)
-	if err != nil {
+	// 校验任务配置
+	if err = validateJob(job); err != nil {
 		return
 	}
 
-	// 保存到etcd
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	putResponse, err := jobMgr.kv.Put(ctx, jobKey, string(jobValue), clientv3.WithPrevKV())
+
+	// 读取旧job，暂停状态只能通过暂停和恢复接口修改，保存时沿用
+	getResp, err := jobMgr.kv.Get(ctx, jobKey)
 	if err != nil {
 		return
 	}
+	cmp := clientv3.Compare(clientv3.CreateRevision(jobKey), "=", 0)
+	if len(getResp.Kvs) != 0 {
+		if err = json.Unmarshal(getResp.Kvs[0].Value, &oldJob); err != nil {
+			return
+		}
+		cmp = clientv3.Compare(clientv3.ModRevision(jobKey), "=", getResp.Kvs[0].ModRevision)
+	}
+	job.Paused = oldJob.Paused
 
-	// 返回旧job,首先判定是否有返回值（更新时返回）
-	if putResponse.PrevKv != nil {
-		err = json.Unmarshal(putResponse.PrevKv.Value, &oldJob)
+	jobValue, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+
+	// 读取之后任务没有被修改才写入，避免覆盖并发的暂停或恢复
+	txnResp, err := jobMgr.kv.Txn(ctx).
+		If(cmp).
+		Then(clientv3.OpPut(jobKey, string(jobValue))).
+		Commit()
+	if err != nil {
+		return
+	}
+	if !txnResp.Succeeded {
+		err = common.ERR_JOB_CONFLICT
 	}
 
 	return
 }
 
+// 校验任务配置
+func validateJob(job *common.Job) (err error) {
+	// 时区必须是合法的IANA名称，与worker解析的结果一致
+	if _, err = job.GetLocation(); err != nil {
+		return
+	}
+
+	// misfire策略
+	switch job.MisfirePolicy {
+	case "", common.MISFIRE_POLICY_SKIP, common.MISFIRE_POLICY_RUN_ONCE, common.MISFIRE_POLICY_RUN_ALL:
+	default:
+		return common.ERR_INVALID_MISFIRE_POLICY
+	}
+
+	// 并发策略
+	switch job.ConcurrencyPolicy {
+	case "", common.CONCURRENCY_POLICY_FORBID, common.CONCURRENCY_POLICY_ALLOW,
+		common.CONCURRENCY_POLICY_REPLACE, common.CONCURRENCY_POLICY_QUEUE:
+	default:
+		return common.ERR_INVALID_CONCURRENCY
+	}
+
+	// 重试策略
+	if err = job.Retry.Validate(); err != nil {
+		return
+	}
+
+	// 命令：shell执行command，或者直接执行args
+	if len(job.Args) != 0 {
+		if job.Args[0] == "" || job.Shell != "" {
+			return common.ERR_INVALID_COMMAND
+		}
+	} else if job.Command == "" {
+		return common.ERR_INVALID_COMMAND
+	}
+
+	// 路径在worker上解析，必须是绝对路径
+	if (job.WorkingDir != "" && !filepath.IsAbs(job.WorkingDir)) || (job.Shell != "" && !filepath.IsAbs(job.Shell)) {
+		return common.ERR_INVALID_PATH
+	}
+
+	// 执行方式
+	switch job.ExecutionMode {
+	case "", common.EXECUTION_MODE_SINGLE, common.EXECUTION_MODE_BROADCAST:
+	default:
+		return common.ERR_INVALID_EXECUTION_MODE
+	}
+
+	// 分片数，广播任务已经在每个worker上执行，不能再分片
+	if job.Shards < 0 || (job.Shards > 1 && job.IsBroadcast()) {
+		return common.ERR_INVALID_SHARDS
+	}
+
+	// worker标签匹配条件
+	if err = job.ValidateNodeSelector(); err != nil {
+		return
+	}
+
+	// 执行身份由worker解析，这里只检查组合是否合法
+	if job.RunAsGroup != "" && job.RunAsUser == "" {
+		return common.ERR_INVALID_RUN_AS
+	}
+
+	// 输出上限，worker上还会与全局配置取较小值
+	if job.MaxOutputBytes < 0 || job.MaxOutputBytes > common.JOB_MAX_OUTPUT_BYTES_LIMIT {
+		return common.ERR_INVALID_MAX_OUTPUT
+	}
+
+	// 资源限制
+	if limits := job.Resources; limits != nil && (limits.CpuQuota < 0 || limits.MemoryMax < 0 || limits.PidsMax < 0) {
+		return common.ERR_INVALID_RESOURCES
+	}
+
+	return validateEnv(job.Env)
+}
+
+// 环境变量名，CRON_前缀留给worker注入的变量；任务和手动触发的环境变量使用相同的规则
+func validateEnv(env map[string]string) error {
+	for key := range env {
+		if !envNameRegexp.MatchString(key) || strings.HasPrefix(key, common.JOB_ENV_PREFIX) {
+			return common.ERR_INVALID_ENV
+		}
+	}
+	return nil
+}
+
 // 删除job
 func (jobMgr *JobMgr) DelJob(name string) (oldJobs []common.Job, err error) {
 	// 构建key
@@ -86,6 +200,14 @@ func (jobMgr *JobMgr) DelJob(name string) (oldJobs []common.Job, err error) {
 		return
 	}
 
+	// 删除任务的水位线，包括各分片的水位线
+	if _, err = jobMgr.kv.Delete(ctx, common.JOB_WATERMARK_DIR+name); err != nil {
+		return
+	}
+	if _, err = jobMgr.kv.Delete(ctx, common.JOB_WATERMARK_DIR+name+"/", clientv3.WithPrefix()); err != nil {
+		return
+	}
+
 	// 返回旧的job 判定slice是否为空，使用len
 	if len(delResp.PrevKvs) != 0 {
 		for _, val := range delResp.PrevKvs {
@@ -126,10 +248,27 @@ func (jobMgr *JobMgr) GetAllJob() (jobs []common.Job, err error) {
 	return
 }
 
-// 杀死任务
-func (jobMgr *JobMgr) KillJob(name string) (err error) {
-	// 构建etcd的key
-	jobKey := common.JOB_KILLER_DIR + name
+// 杀死任务，runId为空杀死所有的执行，返回强杀请求ID和等待worker确认的最长时间
+func (jobMgr *JobMgr) KillJob(name string, runId string) (killId string, waitTime time.Duration, err error) {
+	// 读取任务的宽限期，用于计算等待确认的时间
+	getResp, err := jobMgr.kv.Get(context.Background(), common.JOB_SAVE_DIR+name)
+	if err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_JOB_NOT_FOUND
+		return
+	}
+	job, err := common.Unpack(getResp.Kvs[0].Value)
+	if err != nil {
+		return
+	}
+
+	killer := &common.JobKiller{RunId: runId, KillId: common.BuildRunId(), Reason: common.JOB_KILL_REASON_USER}
+	killerValue, err := json.Marshal(killer)
+	if err != nil {
+		return
+	}
 
 	// 让worker监控到一次put操作，利用租约设定killer的自动过期时间
 	leaseResp, err := jobMgr.lease.Grant(context.Background(), 1)
@@ -137,13 +276,289 @@ func (jobMgr *JobMgr) KillJob(name string) (err error) {
 		return
 	}
 
-	// 获取租约id
-	leaseID := leaseResp.ID
-
 	// kv put操作
-	if _, err = jobMgr.kv.Put(context.Background(), jobKey, "", clientv3.WithLease(leaseID)); err != nil {
+	if _, err = jobMgr.kv.Put(context.Background(), common.JOB_KILLER_DIR+name, string(killerValue), clientv3.WithLease(leaseResp.ID)); err != nil {
 		return
 	}
 
+	// worker确认进程组退出最长需要宽限期加确认时间
+	killId = killer.KillId
+	waitTime = job.GetKillGracePeriod() + common.JOB_KILL_CONFIRM_TIMEOUT + common.JOB_KILLACK_EXTRA_WAIT
+	return
+}
+
+// 等待强杀请求完成，超时后返回当前的确认情况，未确认的worker在pending中
+func (jobMgr *JobMgr) WaitKillResult(killId string, waitTime time.Duration) (killResult *common.KillResult, err error) {
+	deadline := time.Now().Add(waitTime)
+	for {
+		if killResult, err = jobMgr.GetKillResult(killId); err != nil {
+			return
+		}
+		if killResult.Done || !time.Now().Before(deadline) {
+			return
+		}
+		time.Sleep(common.JOB_KILLACK_POLL_INTERVAL)
+	}
+}
+
+// 查询强杀请求的确认，在线worker收到请求并且列出的执行都确认退出后完成
+func (jobMgr *JobMgr) GetKillResult(killId string) (killResult *common.KillResult, err error) {
+	workers, err := G_workerMgr.ListWorkerIps()
+	if err != nil {
+		return
+	}
+
+	acks, err := jobMgr.listKillAcks(killId)
+	if err != nil {
+		return
+	}
+
+	killResult = &common.KillResult{
+		KillId:  killId,
+		Acks:    make([]*common.KillAck, 0),
+		Pending: make([]string, 0),
+	}
+
+	// 区分worker本身的确认和各执行的确认
+	workerAcks := make(map[string]*common.KillAck)
+	killedRuns := make(map[string]bool)
+	for _, ack := range acks {
+		if ack.RunId == "" {
+			workerAcks[ack.Worker] = ack
+			continue
+		}
+		killedRuns[ack.Worker+"/"+ack.RunId] = true
+		killResult.Acks = append(killResult.Acks, ack)
+	}
+
+	for _, worker := range workers {
+		if isKillPending(workerAcks[worker], killedRuns) {
+			killResult.Pending = append(killResult.Pending, worker)
+		}
+	}
+	killResult.Done = len(killResult.Pending) == 0
+
+	return
+}
+
+// worker还没有收到强杀请求，或者还有执行没有确认退出
+func isKillPending(workerAck *common.KillAck, killedRuns map[string]bool) bool {
+	if workerAck == nil {
+		return true
+	}
+	for _, runId := range workerAck.Killing {
+		if !killedRuns[workerAck.Worker+"/"+runId] {
+			return true
+		}
+	}
+	return false
+}
+
+// 获取集群中正在执行的任务，name为空返回所有任务，最早启动的在前
+func (jobMgr *JobMgr) ListRunning(name string) (runningJobs []*common.RunningJob, err error) {
+	// 指定任务时只查询该任务的目录
+	runningKey := common.JOB_RUNNING_DIR
+	if name != "" {
+		runningKey = common.BuildRunningKey(name, "")
+	}
+
+	getResp, err := jobMgr.kv.Get(context.Background(), runningKey, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	runningJobs = make([]*common.RunningJob, 0)
+	for _, val := range getResp.Kvs {
+		var runningJob common.RunningJob
+		if e := json.Unmarshal(val.Value, &runningJob); e != nil {
+			continue
+		}
+		runningJobs = append(runningJobs, &runningJob)
+	}
+
+	sort.Slice(runningJobs, func(i, j int) bool {
+		return runningJobs[i].StartTime < runningJobs[j].StartTime
+	})
+
+	return
+}
+
+// 获取强杀请求的确认
+func (jobMgr *JobMgr) listKillAcks(killId string) (acks []*common.KillAck, err error) {
+	getResp, err := jobMgr.kv.Get(context.Background(), common.JOB_KILLACK_DIR+killId+"/", clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	acks = make([]*common.KillAck, 0)
+	for _, val := range getResp.Kvs {
+		var ack common.KillAck
+		if e := json.Unmarshal(val.Value, &ack); e != nil {
+			continue
+		}
+		acks = append(acks, &ack)
+	}
+
+	return
+}
+
+// 暂停或恢复任务，保留任务定义
+func (jobMgr *JobMgr) SetJobPaused(name string, paused bool) (job common.Job, err error) {
+	jobKey := common.JOB_SAVE_DIR + name
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 读取当前任务
+	getResp, err := jobMgr.kv.Get(ctx, jobKey)
+	if err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_JOB_NOT_FOUND
+		return
+	}
+	if err = json.Unmarshal(getResp.Kvs[0].Value, &job); err != nil {
+		return
+	}
+
+	job.Paused = paused
+	jobValue, err := json.Marshal(&job)
+	if err != nil {
+		return
+	}
+
+	// 读取之后任务没有被修改才写入，避免覆盖并发的保存
+	txnResp, err := jobMgr.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", getResp.Kvs[0].ModRevision)).
+		Then(clientv3.OpPut(jobKey, string(jobValue))).
+		Commit()
+	if err != nil {
+		return
+	}
+	if !txnResp.Succeeded {
+		err = common.ERR_JOB_CONFLICT
+	}
+
+	return
+}
+
+// 手动触发任务，写入/cron/trigger/任务名/触发ID，由一个worker认领执行
+// 分片任务每个分片写入一个触发请求，分别由不同的worker认领
+func (jobMgr *JobMgr) TriggerJob(name string, env map[string]string, args []string) (triggers []*common.JobTrigger, err error) {
+	if err = validateEnv(env); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 读取当前的任务定义
+	getResp, err := jobMgr.kv.Get(ctx, common.JOB_SAVE_DIR+name)
+	if err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_JOB_NOT_FOUND
+		return
+	}
+	job, err := common.Unpack(getResp.Kvs[0].Value)
+	if err != nil {
+		return
+	}
+
+	// 触发请求设置有效期，没有worker执行时自动删除
+	leaseResp, err := jobMgr.lease.Grant(ctx, common.JOB_TRIGGER_TTL)
+	if err != nil {
+		return
+	}
+
+	// 触发状态保留更久，调用方通过它确认触发请求是否被执行
+	statusLeaseResp, err := jobMgr.lease.Grant(ctx, common.JOB_TRIGGER_STATUS_TTL)
+	if err != nil {
+		return
+	}
+	initStatus := common.TRIGGER_STATUS_PENDING
+	if job.IsBroadcast() {
+		initStatus = common.TRIGGER_STATUS_BROADCAST
+	}
+
+	shardTotal := job.Shards
+	if shardTotal <= 1 {
+		shardTotal = 1
+	}
+
+	// 同一次触发的分片使用相同的触发时间，日志中按计划时间归为一次运行
+	triggerTime := time.Now().UnixNano() / 1e6
+	triggers = make([]*common.JobTrigger, 0, shardTotal)
+	for shard := 0; shard < shardTotal; shard++ {
+		trigger := &common.JobTrigger{
+			TriggerId:   common.BuildRunId(),
+			Job:         job,
+			Env:         env,
+			Args:        args,
+			TriggerTime: triggerTime,
+		}
+		if job.Shards > 1 {
+			trigger.ShardIndex = shard
+			trigger.ShardTotal = job.Shards
+		}
+
+		triggerValue, err := json.Marshal(trigger)
+		if err != nil {
+			return nil, err
+		}
+
+		statusValue, err := json.Marshal(&common.JobTriggerStatus{
+			TriggerId:  trigger.TriggerId,
+			JobName:    job.Name,
+			Status:     initStatus,
+			UpdateTime: triggerTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// 触发请求和状态同时写入
+		if _, err = jobMgr.kv.Txn(ctx).Then(
+			clientv3.OpPut(common.BuildTriggerKey(trigger), string(triggerValue), clientv3.WithLease(leaseResp.ID)),
+			clientv3.OpPut(common.BuildTriggerStatusKey(trigger.TriggerId), string(statusValue), clientv3.WithLease(statusLeaseResp.ID)),
+		).Commit(); err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, trigger)
+	}
+
+	return
+}
+
+// 查询手动触发请求的状态，等待认领的请求已经过期删除时返回expired
+func (jobMgr *JobMgr) GetTriggerStatus(name string, triggerId string) (status *common.JobTriggerStatus, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 在同一个版本读取状态和触发请求，worker认领时同时删除请求和更新状态
+	txnResp, err := jobMgr.kv.Txn(ctx).Then(
+		clientv3.OpGet(common.BuildTriggerStatusKey(triggerId)),
+		clientv3.OpGet(common.JOB_TRIGGER_DIR+name+"/"+triggerId),
+	).Commit()
+	if err != nil {
+		return
+	}
+
+	statusKvs := txnResp.Responses[0].GetResponseRange().Kvs
+	if len(statusKvs) == 0 {
+		err = common.ERR_TRIGGER_NOT_FOUND
+		return
+	}
+	status = &common.JobTriggerStatus{}
+	if err = json.Unmarshal(statusKvs[0].Value, status); err != nil {
+		return
+	}
+
+	if status.Status == common.TRIGGER_STATUS_PENDING && len(txnResp.Responses[1].GetResponseRange().Kvs) == 0 {
+		status.Status = common.TRIGGER_STATUS_EXPIRED
+		status.Err = "no worker claimed the trigger in time"
+	}
 	return
 }
@@ -0,0 +1,116 @@
+package master
+
+import (
+	"encoding/json"
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 保存一个任务，事务按succeeded返回
+type fakeJobKV struct {
+	clientv3.KV
+	value     []byte
+	succeeded bool
+}
+
+func (kv *fakeJobKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	getResp := &clientv3.GetResponse{}
+	if kv.value != nil {
+		getResp.Kvs = []*mvccpb.KeyValue{{Key: []byte(key), Value: kv.value, ModRevision: 1}}
+	}
+	return getResp, nil
+}
+
+func (kv *fakeJobKV) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeJobTxn{succeeded: kv.succeeded}
+}
+
+type fakeJobTxn struct {
+	succeeded bool
+}
+
+func (txn *fakeJobTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { return txn }
+func (txn *fakeJobTxn) Then(ops ...clientv3.Op) clientv3.Txn { return txn }
+func (txn *fakeJobTxn) Else(ops ...clientv3.Op) clientv3.Txn { return txn }
+func (txn *fakeJobTxn) Commit() (*clientv3.TxnResponse, error) {
+	return &clientv3.TxnResponse{Succeeded: txn.succeeded}, nil
+}
+
+func TestSaveJobKeepsPaused(t *testing.T) {
+	stored, _ := json.Marshal(&common.Job{Name: "job", Command: "echo old", CronExpr: "* * * * *", Paused: true})
+	jobMgr := &JobMgr{kv: &fakeJobKV{value: stored, succeeded: true}}
+
+	// 编辑时没有带上paused，仍然保持暂停
+	job := &common.Job{Name: "job", Command: "echo new", CronExpr: "* * * * *"}
+	oldJob, err := jobMgr.SaveJob(job)
+	if err != nil {
+		t.Fatalf("SaveJob() err: %v", err)
+	}
+	if !job.Paused || oldJob.Command != "echo old" {
+		t.Fatalf("SaveJob() paused = %v, old command = %v", job.Paused, oldJob.Command)
+	}
+
+	// 新任务不能通过保存直接暂停
+	jobMgr = &JobMgr{kv: &fakeJobKV{succeeded: true}}
+	job = &common.Job{Name: "job", Command: "echo new", CronExpr: "* * * * *", Paused: true}
+	if _, err = jobMgr.SaveJob(job); err != nil || job.Paused {
+		t.Fatalf("SaveJob() new job paused = %v, err: %v", job.Paused, err)
+	}
+
+	// 读取之后被暂停或恢复
+	jobMgr = &JobMgr{kv: &fakeJobKV{value: stored}}
+	if _, err = jobMgr.SaveJob(&common.Job{Name: "job", Command: "echo new", CronExpr: "* * * * *"}); err != common.ERR_JOB_CONFLICT {
+		t.Fatalf("SaveJob() err = %v, want ERR_JOB_CONFLICT", err)
+	}
+}
+
+// 一个在线worker，第ackAfter次读取确认之后才能读到worker的确认
+type fakeKillKV struct {
+	clientv3.KV
+	ackAfter int
+	ackGets  int
+}
+
+func (kv *fakeKillKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	getResp := &clientv3.GetResponse{}
+	if key == common.JOB_WORKER_DIR {
+		getResp.Kvs = []*mvccpb.KeyValue{{Key: []byte(common.JOB_WORKER_DIR + "10.0.0.1")}}
+		return getResp, nil
+	}
+	if strings.HasPrefix(key, common.JOB_KILLACK_DIR) {
+		kv.ackGets++
+		if kv.ackGets >= kv.ackAfter {
+			value, _ := json.Marshal(&common.KillAck{KillId: "kill", Worker: "10.0.0.1"})
+			getResp.Kvs = []*mvccpb.KeyValue{{Key: []byte(key + "10.0.0.1"), Value: value}}
+		}
+	}
+	return getResp, nil
+}
+
+func TestWaitKillResult(t *testing.T) {
+	oldWorkerMgr := G_workerMgr
+	defer func() { G_workerMgr = oldWorkerMgr }()
+
+	// worker稍后确认，等到确认之后返回
+	kv := &fakeKillKV{ackAfter: 3}
+	G_workerMgr = &WorkerMgr{kv: kv}
+	jobMgr := &JobMgr{kv: kv}
+	killResult, err := jobMgr.WaitKillResult("kill", time.Minute)
+	if err != nil || !killResult.Done || len(killResult.Pending) != 0 || kv.ackGets != 3 {
+		t.Fatalf("WaitKillResult() = %+v, gets = %v, err: %v", killResult, kv.ackGets, err)
+	}
+
+	// 超时仍未确认，返回pending的worker
+	kv = &fakeKillKV{ackAfter: 1 << 30}
+	G_workerMgr = &WorkerMgr{kv: kv}
+	jobMgr = &JobMgr{kv: kv}
+	killResult, err = jobMgr.WaitKillResult("kill", 0)
+	if err != nil || killResult.Done || len(killResult.Pending) != 1 || killResult.Pending[0] != "10.0.0.1" {
+		t.Fatalf("WaitKillResult() = %+v, err: %v", killResult, err)
+	}
+}
@@ -3,14 +3,19 @@ package master
 import (
 	"github.com/MrDragon1122/crontab/common"
 	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/gridfs"
 	"github.com/mongodb/mongo-go-driver/mongo/options"
 	"golang.org/x/net/context"
+	"sort"
+	"strconv"
+	"traefik/log"
 )
 
 // mongodb存储相关
 type LogMgr struct {
-	client        *mongo.Client
-	logCollection *mongo.Collection
+	client          *mongo.Client
+	logCollection   *mongo.Collection
+	chunkCollection *mongo.Collection // 实时输出分片
 }
 
 // 定义单例
@@ -26,10 +31,24 @@ func InitLogMgr() (err error) {
 	}
 
 	G_logMgr = &LogMgr{
-		client:        client,
-		logCollection: client.Database("cron").Collection("log"),
+		client:          client,
+		logCollection:   client.Database("cron").Collection("log"),
+		chunkCollection: client.Database("cron").Collection("log_chunk"),
 	}
 
+	// 索引创建失败不影响查询
+	if err := G_logMgr.createLogIndexes(); err != nil {
+		log.Errorf("create log indexes err: %v", err)
+	}
+
+	return
+}
+
+// 创建日志的索引：按任务聚合计划时间
+func (logMgr *LogMgr) createLogIndexes() (err error) {
+	_, err = logMgr.logCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: &common.JobLogPlanTimeIndex{JobName: 1, PlanTime: 1},
+	})
 	return
 }
 
@@ -67,3 +86,169 @@ func (logMgr *LogMgr) ListLog(name string, skip, limit *int64) (logArr []*common
 
 	return
 }
+
+// 获取广播、分片任务最近的调度，按计划时间把各worker或各分片的日志归为一组
+func (logMgr *LogMgr) ListRunGroups(name string, skip, limit int) (runArr []*common.JobRunGroup, err error) {
+	runArr = make([]*common.JobRunGroup, 0)
+
+	// 任务的计划时间，在mongodb中倒序分页
+	cursor, err := logMgr.logCollection.Aggregate(context.Background(), buildPlanTimePipeline(name, skip, limit))
+	if err != nil {
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	planTimes := make([]int64, 0, limit)
+	for cursor.Next(context.Background()) {
+		group := &common.PlanTimeGroup{}
+		if err := cursor.Decode(group); err != nil {
+			continue
+		}
+		planTimes = append(planTimes, group.PlanTime)
+	}
+	if len(planTimes) == 0 {
+		return
+	}
+
+	// 查询这些计划时间的日志
+	filter := &common.BroadcastLogFilter{JobName: name, PlanTime: common.InInt64{In: planTimes}}
+	logCursor, err := logMgr.logCollection.Find(context.Background(), filter)
+	if err != nil {
+		return
+	}
+	defer logCursor.Close(context.Background())
+
+	logs := make([]*common.JobLog, 0)
+	for logCursor.Next(context.Background()) {
+		jobLog := &common.JobLog{}
+		if err := logCursor.Decode(jobLog); err != nil {
+			continue
+		}
+		logs = append(logs, jobLog)
+	}
+
+	runArr = groupRunLogs(planTimes, logs)
+	return
+}
+
+// 按计划时间分组后倒序分页的聚合管道
+func buildPlanTimePipeline(name string, skip, limit int) []interface{} {
+	return []interface{}{
+		&common.MatchJobLog{Match: common.JobLogFilter{JobName: name}},
+		&common.GroupByPlanTime{Group: common.PlanTimeGroupId{Id: "$planTime"}},
+		&common.SortPlanTimeGroup{Sort: common.SortByGroupId{SortOrder: -1}},
+		&common.SkipStage{Skip: int64(skip)},
+		&common.LimitStage{Limit: int64(limit)},
+	}
+}
+
+// 按计划时间分组，顺序与planTimes一致
+func groupRunLogs(planTimes []int64, logs []*common.JobLog) (runArr []*common.JobRunGroup) {
+	runArr = make([]*common.JobRunGroup, 0, len(planTimes))
+
+	// 每个worker或分片只保留最后一次尝试
+	groupLogs := make(map[int64]map[string]*common.JobLog)
+	shardTotals := make(map[int64]int)
+	for _, jobLog := range logs {
+		key := jobLog.Worker
+		if jobLog.ShardTotal > 1 {
+			key = strconv.Itoa(jobLog.ShardIndex)
+			shardTotals[jobLog.PlanTime] = jobLog.ShardTotal
+		}
+
+		if groupLogs[jobLog.PlanTime] == nil {
+			groupLogs[jobLog.PlanTime] = make(map[string]*common.JobLog)
+		}
+		if last, ok := groupLogs[jobLog.PlanTime][key]; !ok || jobLog.Attempt > last.Attempt {
+			groupLogs[jobLog.PlanTime][key] = jobLog
+		}
+	}
+
+	for _, planTime := range planTimes {
+		run := &common.JobRunGroup{PlanTime: planTime, Logs: make([]*common.JobLog, 0)}
+		for _, jobLog := range groupLogs[planTime] {
+			if jobLog.Status == common.JOB_STATUS_SUCCESS {
+				run.Success++
+			} else {
+				run.Failed++
+			}
+			run.Logs = append(run.Logs, jobLog)
+		}
+
+		// 分片任务的总数是分片数，还没上报的分片既不算成功也不算失败
+		run.Total = len(run.Logs)
+		if shardTotal, ok := shardTotals[planTime]; ok {
+			run.Total = shardTotal
+			sort.Slice(run.Logs, func(i, j int) bool { return run.Logs[i].ShardIndex < run.Logs[j].ShardIndex })
+		} else {
+			sort.Slice(run.Logs, func(i, j int) bool { return run.Logs[i].Worker < run.Logs[j].Worker })
+		}
+		runArr = append(runArr, run)
+	}
+
+	return
+}
+
+// 获取某次执行序号seq之后的输出分片，最多limit条
+func (logMgr *LogMgr) ListLogChunk(runId string, seq int64, limit int64) (chunkArr []*common.JobLogChunk, err error) {
+	chunkArr = make([]*common.JobLogChunk, 0)
+
+	// 按分片序号正序
+	filter := &common.JobLogChunkFilter{RunId: runId, Seq: common.GreaterThan{Gt: seq}}
+	chunkSort := &common.SortLogChunkBySeq{SortOrder: 1}
+
+	cursor, err := logMgr.chunkCollection.Find(context.Background(), filter, &options.FindOptions{Sort: chunkSort, Limit: &limit})
+	if err != nil {
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		chunk := &common.JobLogChunk{}
+		if err := cursor.Decode(chunk); err != nil {
+			continue
+		}
+
+		chunkArr = append(chunkArr, chunk)
+	}
+
+	return
+}
+
+// 打开某次执行保存在GridFS中的完整输出
+func (logMgr *LogMgr) OpenOutputSpill(runId string) (stream *gridfs.DownloadStream, err error) {
+	bucket, err := gridfs.NewBucket(logMgr.client.Database("cron"), options.GridFSBucket().SetName(common.JOB_OUTPUT_BUCKET))
+	if err != nil {
+		return
+	}
+
+	if stream, err = bucket.OpenDownloadStreamByName(runId); err == gridfs.ErrFileNotFound {
+		err = common.ERR_NO_SPILLED_OUTPUT
+	}
+	return
+}
+
+// 获取任务最近一次执行的ID
+func (logMgr *LogMgr) GetLatestRunId(name string) (runId string, err error) {
+	filter := &common.JobLogFilter{JobName: name}
+	chunkSort := &common.SortLogChunkByTime{SortOrder: -1}
+	limit := int64(1)
+
+	cursor, err := logMgr.chunkCollection.Find(context.Background(), filter, &options.FindOptions{Sort: chunkSort, Limit: &limit})
+	if err != nil {
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	if cursor.Next(context.Background()) {
+		chunk := &common.JobLogChunk{}
+		if err = cursor.Decode(chunk); err != nil {
+			return
+		}
+		runId = chunk.RunId
+		return
+	}
+
+	err = common.ERR_NO_RUNNING_LOG
+	return
+}
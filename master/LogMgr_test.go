@@ -0,0 +1,69 @@
+package master
+
+import (
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"reflect"
+	"testing"
+)
+
+func TestBuildPlanTimePipeline(t *testing.T) {
+	var stages []string
+	for _, stage := range buildPlanTimePipeline("job", 20, 10) {
+		doc, err := bson.Marshal(stage)
+		if err != nil {
+			t.Fatalf("bson.Marshal(%T) err: %v", stage, err)
+		}
+		stages = append(stages, bson.Raw(doc).String())
+	}
+
+	want := []string{
+		`{"$match": {"jobName": "job"}}`,
+		`{"$group": {"_id": "$planTime"}}`,
+		`{"$sort": {"_id": {"$numberInt":"-1"}}}`,
+		`{"$skip": {"$numberLong":"20"}}`,
+		`{"$limit": {"$numberLong":"10"}}`,
+	}
+	if !reflect.DeepEqual(stages, want) {
+		t.Fatalf("buildPlanTimePipeline() = %v, want %v", stages, want)
+	}
+}
+
+func TestGroupRunLogs(t *testing.T) {
+	logs := []*common.JobLog{
+		// 广播任务：每个worker只保留最后一次尝试
+		{Worker: "10.0.0.2", PlanTime: 2000, Attempt: 1, Status: common.JOB_STATUS_FAILED},
+		{Worker: "10.0.0.2", PlanTime: 2000, Attempt: 2, Status: common.JOB_STATUS_SUCCESS},
+		{Worker: "10.0.0.1", PlanTime: 2000, Attempt: 1, Status: common.JOB_STATUS_TIMEOUT},
+		// 分片任务：3个分片只上报了2个，同一分片在不同worker上的重试按分片归并
+		{Worker: "10.0.0.1", PlanTime: 1000, ShardIndex: 2, ShardTotal: 3, Attempt: 2, Status: common.JOB_STATUS_SUCCESS},
+		{Worker: "10.0.0.2", PlanTime: 1000, ShardIndex: 2, ShardTotal: 3, Attempt: 1, Status: common.JOB_STATUS_FAILED},
+		{Worker: "10.0.0.2", PlanTime: 1000, ShardIndex: 0, ShardTotal: 3, Attempt: 1, Status: common.JOB_STATUS_KILLED},
+	}
+
+	runArr := groupRunLogs([]int64{3000, 2000, 1000}, logs)
+	if len(runArr) != 3 {
+		t.Fatalf("groupRunLogs() returned %v groups, want 3", len(runArr))
+	}
+
+	// 没有日志的计划时间保留空分组
+	if run := runArr[0]; run.PlanTime != 3000 || run.Total != 0 || len(run.Logs) != 0 {
+		t.Fatalf("empty group = %+v", run)
+	}
+
+	broadcast := runArr[1]
+	if broadcast.PlanTime != 2000 || broadcast.Total != 2 || broadcast.Success != 1 || broadcast.Failed != 1 {
+		t.Fatalf("broadcast group = %+v, want total 2 success 1 failed 1", broadcast)
+	}
+	if broadcast.Logs[0].Worker != "10.0.0.1" || broadcast.Logs[1].Worker != "10.0.0.2" || broadcast.Logs[1].Attempt != 2 {
+		t.Fatalf("broadcast logs not sorted by worker with last attempt: %+v %+v", broadcast.Logs[0], broadcast.Logs[1])
+	}
+
+	shard := runArr[2]
+	if shard.PlanTime != 1000 || shard.Total != 3 || shard.Success != 1 || shard.Failed != 1 {
+		t.Fatalf("shard group = %+v, want total 3 success 1 failed 1", shard)
+	}
+	if shard.Logs[0].ShardIndex != 0 || shard.Logs[1].ShardIndex != 2 || shard.Logs[1].Attempt != 2 {
+		t.Fatalf("shard logs not sorted by index with last attempt: %+v %+v", shard.Logs[0], shard.Logs[1])
+	}
+}
@@ -1,10 +1,12 @@
 package master
 
 import (
+	"encoding/json"
 	"github.com/MrDragon1122/crontab/common"
 	"github.com/coreos/etcd/clientv3"
 	"golang.org/x/net/context"
 	"time"
+	"traefik/log"
 )
 
 // cron/workers
@@ -46,9 +48,10 @@ func InitWorkerMgr() (err error) {
 	return
 }
 
-func (workerMgr *WorkerMgr) ListWorkers() (workerArr []string, err error) {
+// 获取在线的worker及其节点信息
+func (workerMgr *WorkerMgr) ListWorkers() (workerArr []*common.WorkerInfo, err error) {
 	// 初始化操作
-	workerArr = make([]string, 0)
+	workerArr = make([]*common.WorkerInfo, 0)
 
 	// 获取wokers
 	getResponse, err := workerMgr.kv.Get(context.Background(), common.JOB_WORKER_DIR, clientv3.WithPrefix())
@@ -58,9 +61,84 @@ func (workerMgr *WorkerMgr) ListWorkers() (workerArr []string, err error) {
 
 	for _, val := range getResponse.Kvs {
 		// key: /cron/woker/192.1.1.1
-		workerIp := common.ExtractWorkerIp(string(val.Key))
-		workerArr = append(workerArr, workerIp)
+		workerInfo := &common.WorkerInfo{}
+		if len(val.Value) != 0 {
+			if e := json.Unmarshal(val.Value, workerInfo); e != nil {
+				log.Errorf("unpack worker info err: %v", e)
+			}
+		}
+		// 旧版本的worker注册值为空，只有ip
+		workerInfo.Ip = common.ExtractWorkerIp(string(val.Key))
+		workerArr = append(workerArr, workerInfo)
 	}
 
 	return
 }
+
+// 获取在线worker的ip
+func (workerMgr *WorkerMgr) ListWorkerIps() (workerIps []string, err error) {
+	workerArr, err := workerMgr.ListWorkers()
+	if err != nil {
+		return
+	}
+
+	workerIps = make([]string, 0, len(workerArr))
+	for _, workerInfo := range workerArr {
+		workerIps = append(workerIps, workerInfo.Ip)
+	}
+	return
+}
+
+// 是否有在线的worker可以执行该任务
+func (workerMgr *WorkerMgr) HasMatchingWorker(job *common.Job) (matched bool, err error) {
+	workerArr, err := workerMgr.ListWorkers()
+	if err != nil {
+		return
+	}
+
+	for _, workerInfo := range workerArr {
+		if job.MatchLabels(workerInfo.Labels) {
+			return true, nil
+		}
+	}
+	return
+}
+
+// 请求worker下线，worker不再执行新任务，等待正在执行的任务结束后退出
+func (workerMgr *WorkerMgr) DrainWorker(ip string, timeout int) (err error) {
+	workerIps, err := workerMgr.ListWorkerIps()
+	if err != nil {
+		return
+	}
+
+	found := false
+	for _, workerIp := range workerIps {
+		if workerIp == ip {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return common.ERR_WORKER_NOT_FOUND
+	}
+
+	drainValue, err := json.Marshal(&common.DrainRequest{
+		Ip:          ip,
+		Timeout:     timeout,
+		RequestTime: time.Now().UnixNano() / 1e6,
+	})
+	if err != nil {
+		return
+	}
+
+	// 下线请求设置有效期，worker重启后不会再次下线
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	leaseResp, err := workerMgr.lease.Grant(ctx, common.JOB_DRAIN_TTL)
+	if err != nil {
+		return
+	}
+
+	_, err = workerMgr.kv.Put(ctx, common.JOB_DRAIN_DIR+ip, string(drainValue), clientv3.WithLease(leaseResp.ID))
+	return
+}
@@ -0,0 +1,399 @@
+package master
+
+import (
+	"encoding/json"
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+	"sort"
+	"time"
+	"traefik/log"
+)
+
+// 工作流管理
+type WorkflowMgr struct {
+	client *clientv3.Client
+	kv     clientv3.KV
+	lease  clientv3.Lease
+}
+
+// 单例
+var (
+	G_workflowMgr *WorkflowMgr
+)
+
+func InitWorkflowMgr() (err error) {
+	// 初始化配置
+	config := clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,                                     // 字符串数组
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 超时
+	}
+
+	// 建立连接
+	client, err := clientv3.New(config)
+	if err != nil {
+		return
+	}
+
+	// 赋值单例
+	G_workflowMgr = &WorkflowMgr{
+		client: client,
+		kv:     clientv3.NewKV(client),
+		lease:  clientv3.NewLease(client),
+	}
+
+	go G_workflowMgr.reapLoop()
+
+	return
+}
+
+// 保存工作流到/cron/workflows/工作流名
+func (workflowMgr *WorkflowMgr) SaveWorkflow(workflow *common.Workflow) (err error) {
+	// 校验依赖关系
+	if err = workflow.Validate(); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 节点引用的任务必须存在
+	for _, node := range workflow.Nodes {
+		getResp, err := workflowMgr.kv.Get(ctx, common.JOB_SAVE_DIR+node.JobName, clientv3.WithCountOnly())
+		if err != nil {
+			return err
+		}
+		if getResp.Count == 0 {
+			return common.ERR_JOB_NOT_FOUND
+		}
+	}
+
+	value, err := json.Marshal(workflow)
+	if err != nil {
+		return
+	}
+
+	_, err = workflowMgr.kv.Put(ctx, common.WORKFLOW_SAVE_DIR+workflow.Name, string(value))
+	return
+}
+
+// 删除工作流，已有的运行记录保留到过期
+func (workflowMgr *WorkflowMgr) DelWorkflow(name string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = workflowMgr.kv.Delete(ctx, common.WORKFLOW_SAVE_DIR+name)
+	return
+}
+
+// 获取所有的工作流
+func (workflowMgr *WorkflowMgr) ListWorkflows() (workflows []*common.Workflow, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	getResp, err := workflowMgr.kv.Get(ctx, common.WORKFLOW_SAVE_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	workflows = make([]*common.Workflow, 0)
+	for _, val := range getResp.Kvs {
+		if workflow, e := common.UnpackWorkflow(val.Value); e == nil {
+			workflows = append(workflows, workflow)
+		}
+	}
+
+	return
+}
+
+// 获取工作流的运行记录，最近启动的在前
+func (workflowMgr *WorkflowMgr) ListWorkflowRuns(name string) (runs []*common.WorkflowRun, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	getResp, err := workflowMgr.kv.Get(ctx, common.BuildWorkflowRunKey(name, ""), clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	runs = make([]*common.WorkflowRun, 0)
+	for _, val := range getResp.Kvs {
+		if run, e := common.UnpackWorkflowRun(val.Value); e == nil {
+			runs = append(runs, run)
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartTime > runs[j].StartTime
+	})
+
+	return
+}
+
+// 手动启动工作流，起始节点通过手动触发交给worker执行
+func (workflowMgr *WorkflowMgr) StartWorkflowRun(name string) (run *common.WorkflowRun, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	getResp, err := workflowMgr.kv.Get(ctx, common.WORKFLOW_SAVE_DIR+name)
+	if err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_WORKFLOW_NOT_FOUND
+		return
+	}
+	workflow, err := common.UnpackWorkflow(getResp.Kvs[0].Value)
+	if err != nil {
+		return
+	}
+
+	// 先保存运行记录，节点结束时worker基于它推进下游
+	run = common.BuildWorkflowRun(workflow, common.BuildRunId())
+	triggers, err := workflowMgr.startReadyNodes(ctx, run)
+	if err != nil {
+		return
+	}
+	runValue, err := json.Marshal(run)
+	if err != nil {
+		return
+	}
+	runLease, err := workflowMgr.lease.Grant(ctx, common.WORKFLOW_RUN_TTL)
+	if err != nil {
+		return
+	}
+	if _, err = workflowMgr.kv.Put(ctx, common.BuildWorkflowRunKey(workflow.Name, run.RunId), string(runValue), clientv3.WithLease(runLease.ID)); err != nil {
+		return
+	}
+
+	// 触发失败的节点由reapLoop按失败处理
+	err = workflowMgr.triggerNodes(ctx, triggers)
+	return
+}
+
+// 定期把卡住的节点按失败处理，避免运行记录一直停在running
+func (workflowMgr *WorkflowMgr) reapLoop() {
+	for range time.Tick(common.WORKFLOW_REAP_INTERVAL) {
+		ctx, cancel := context.WithTimeout(context.Background(), common.WORKFLOW_REAP_INTERVAL)
+		reaped, err := workflowMgr.ReapWorkflowRuns(ctx)
+		cancel()
+
+		if err != nil {
+			log.Errorf("reap workflow runs err: %v", err)
+		}
+		if reaped != 0 {
+			log.Warnf("reaped %v stuck workflow nodes", reaped)
+		}
+	}
+}
+
+// 清理卡住的节点：触发请求过期没有被认领(没有匹配的worker或者都拒绝了)、等锁超时或被取消、
+// 执行的worker宕机、广播节点没有worker执行、触发状态丢失的节点按失败处理并推进下游，返回处理的节点数
+func (workflowMgr *WorkflowMgr) ReapWorkflowRuns(ctx context.Context) (reaped int, err error) {
+	getResp, err := workflowMgr.kv.Get(ctx, common.WORKFLOW_RUN_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	// 触发请求的有效期过后仍未被认领，才认为节点无法启动
+	deadline := time.Now().Add(-(common.JOB_TRIGGER_TTL+common.WORKFLOW_NODE_GRACE)*time.Second).UnixNano() / 1e6
+
+	for _, kv := range getResp.Kvs {
+		run, e := common.UnpackWorkflowRun(kv.Value)
+		if e != nil || run.Status != common.WORKFLOW_STATUS_RUNNING {
+			continue
+		}
+
+		for jobName, nodeRun := range run.Nodes {
+			if nodeRun.Status != common.WORKFLOW_STATUS_RUNNING || nodeRun.StartTime > deadline {
+				continue
+			}
+
+			stuck, err := workflowMgr.isNodeStuck(ctx, jobName, nodeRun.RunId, deadline)
+			if err != nil {
+				return reaped, err
+			}
+			if !stuck {
+				continue
+			}
+
+			log.Warnf("workflow %v run %v node %v is stuck, mark failed", run.Workflow.Name, run.RunId, jobName)
+			if err = workflowMgr.FinishWorkflowNode(ctx, run.Workflow.Name, run.RunId, jobName, common.WORKFLOW_STATUS_FAILED); err != nil {
+				return reaped, err
+			}
+			reaped++
+		}
+	}
+	return
+}
+
+// 读取节点的触发状态，执行中和广播的节点再确认集群中是否还有这次执行
+func (workflowMgr *WorkflowMgr) isNodeStuck(ctx context.Context, jobName string, triggerId string, deadline int64) (stuck bool, err error) {
+	getResp, err := workflowMgr.kv.Get(ctx, common.BuildTriggerStatusKey(triggerId))
+	if err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		return common.IsWorkflowNodeStuck(nil, false, deadline), nil
+	}
+
+	triggerStatus := &common.JobTriggerStatus{}
+	if err = json.Unmarshal(getResp.Kvs[0].Value, triggerStatus); err != nil {
+		return
+	}
+
+	// 执行记录随worker的租约过期，节点的执行ID即触发ID
+	running := false
+	if triggerStatus.Status == common.TRIGGER_STATUS_RUNNING || triggerStatus.Status == common.TRIGGER_STATUS_BROADCAST {
+		runningResp, err := workflowMgr.kv.Get(ctx, common.BuildRunningKey(jobName, triggerId), clientv3.WithCountOnly())
+		if err != nil {
+			return false, err
+		}
+		running = runningResp.Count != 0
+	}
+
+	return common.IsWorkflowNodeStuck(triggerStatus, running, deadline), nil
+}
+
+// 节点结束，更新运行记录并触发满足条件的下游节点，节点已经结束时忽略
+func (workflowMgr *WorkflowMgr) FinishWorkflowNode(ctx context.Context, workflowName string, runId string, jobName string, status string) (err error) {
+	runKey := common.BuildWorkflowRunKey(workflowName, runId)
+
+	// 与worker上报的结果并发，按版本号比较更新，冲突时重试
+	for i := 0; i < common.WORKFLOW_UPDATE_RETRY; i++ {
+		getResp, err := workflowMgr.kv.Get(ctx, runKey)
+		if err != nil {
+			return err
+		}
+		if len(getResp.Kvs) == 0 {
+			return common.ERR_WORKFLOW_NOT_FOUND
+		}
+
+		run, err := common.UnpackWorkflowRun(getResp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+		if nodeRun, ok := run.Nodes[jobName]; !ok || nodeRun.Status != common.WORKFLOW_STATUS_RUNNING {
+			return nil
+		}
+
+		run.FinishNode(jobName, status)
+		triggers, err := workflowMgr.startReadyNodes(ctx, run)
+		if err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+
+		txnResp, err := workflowMgr.kv.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(runKey), "=", getResp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(runKey, string(value), clientv3.WithIgnoreLease())).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txnResp.Succeeded {
+			continue
+		}
+
+		if run.Status != common.WORKFLOW_STATUS_RUNNING {
+			log.Infof("workflow %v run %v finished: %v", workflowName, runId, run.Status)
+		}
+		return workflowMgr.triggerNodes(ctx, triggers)
+	}
+
+	return common.ERR_JOB_CONFLICT
+}
+
+// 推进工作流并标记可以启动的节点，任务已经不存在的节点直接失败
+func (workflowMgr *WorkflowMgr) startReadyNodes(ctx context.Context, run *common.WorkflowRun) (triggers []*common.JobTrigger, err error) {
+	for {
+		ready := run.Advance()
+		if len(ready) == 0 {
+			return
+		}
+
+		failed := false
+		for _, jobName := range ready {
+			job, err := workflowMgr.getJob(ctx, jobName)
+			if err != nil && err != common.ERR_JOB_NOT_FOUND {
+				return nil, err
+			}
+
+			run.StartNode(jobName, common.BuildRunId())
+			if err == common.ERR_JOB_NOT_FOUND {
+				run.FinishNode(jobName, common.WORKFLOW_STATUS_FAILED)
+				failed = true
+				continue
+			}
+			triggers = append(triggers, run.BuildNodeTrigger(jobName, job))
+		}
+
+		// 失败的节点会影响下游，重新推进
+		if !failed {
+			return
+		}
+	}
+}
+
+// 读取节点的任务定义
+func (workflowMgr *WorkflowMgr) getJob(ctx context.Context, jobName string) (job *common.Job, err error) {
+	getResp, err := workflowMgr.kv.Get(ctx, common.JOB_SAVE_DIR+jobName)
+	if err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_JOB_NOT_FOUND
+		return
+	}
+	return common.Unpack(getResp.Kvs[0].Value)
+}
+
+// 通过手动触发的方式启动节点，同时写入pending状态，广播任务写入broadcast状态
+func (workflowMgr *WorkflowMgr) triggerNodes(ctx context.Context, triggers []*common.JobTrigger) (err error) {
+	if len(triggers) == 0 {
+		return
+	}
+
+	// 与手动触发一致，未被认领的请求过期自动删除
+	leaseResp, err := workflowMgr.lease.Grant(ctx, common.JOB_TRIGGER_TTL)
+	if err != nil {
+		return
+	}
+	statusLeaseResp, err := workflowMgr.lease.Grant(ctx, common.JOB_TRIGGER_STATUS_TTL)
+	if err != nil {
+		return
+	}
+
+	for _, trigger := range triggers {
+		initStatus := common.TRIGGER_STATUS_PENDING
+		if trigger.Job.IsBroadcast() {
+			initStatus = common.TRIGGER_STATUS_BROADCAST
+		}
+
+		triggerValue, err := json.Marshal(trigger)
+		if err != nil {
+			return err
+		}
+		statusValue, err := json.Marshal(&common.JobTriggerStatus{
+			TriggerId:  trigger.TriggerId,
+			JobName:    trigger.Job.Name,
+			Status:     initStatus,
+			UpdateTime: trigger.TriggerTime,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err = workflowMgr.kv.Txn(ctx).Then(
+			clientv3.OpPut(common.BuildTriggerKey(trigger), string(triggerValue), clientv3.WithLease(leaseResp.ID)),
+			clientv3.OpPut(common.BuildTriggerStatusKey(trigger.TriggerId), string(statusValue), clientv3.WithLease(statusLeaseResp.ID)),
+		).Commit(); err != nil {
+			return err
+		}
+	}
+	return
+}
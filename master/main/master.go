@@ -5,6 +5,7 @@ import (
 
 	"github.com/MrDragon1122/crontab/master"
 	"os"
+	_ "time/tzdata" // 内置时区数据，master和worker解析时区的结果一致
 	"traefik/log"
 )
 
@@ -52,6 +53,13 @@ func main() {
 	}
 	log.Info("init job mgr success")
 
+	// 初始化工作流管理器
+	if err := master.InitWorkflowMgr(); err != nil {
+		log.Errorf("init workflow mgr error: %v", err)
+		os.Exit(6)
+	}
+	log.Info("init workflow mgr success")
+
 	// 启动Api Http请求
 	if err := master.InitApiServer(); err != nil {
 		log.Errorf("init api server error: %v", err)
@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 一次执行的cgroup v2子目录，子进程启动时直接放入，避免启动后再迁移的窗口期
+type Cgroup struct {
+	path string
+	fd   *os.File
+}
+
+// 在worker的cgroup目录下为本次执行创建子目录，并写入资源限制
+func NewCgroup(runId string, limits *common.ResourceLimits) (cgroup *Cgroup, err error) {
+	root := G_config.CgroupRoot
+
+	// 开启子目录需要的控制器，已开启时写入不会报错
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrap(err, "cgroup unavailable")
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644); err != nil {
+		return nil, errors.Wrap(err, "cgroup unavailable")
+	}
+
+	path := filepath.Join(root, runId)
+	if err = os.Mkdir(path, 0755); err != nil {
+		return nil, errors.Wrap(err, "cgroup unavailable")
+	}
+	cgroup = &Cgroup{path: path}
+
+	// 限制写入失败时删除目录，不在无限制的情况下执行
+	if err = cgroup.setLimits(limits); err != nil {
+		cgroup.Remove()
+		return nil, errors.Wrap(err, "cgroup unavailable")
+	}
+
+	if cgroup.fd, err = os.Open(path); err != nil {
+		cgroup.Remove()
+		return nil, errors.Wrap(err, "cgroup unavailable")
+	}
+
+	return
+}
+
+// 写入cpu、内存、进程数限制
+func (cgroup *Cgroup) setLimits(limits *common.ResourceLimits) (err error) {
+	if limits.CpuQuota > 0 {
+		quota := int64(limits.CpuQuota * float64(common.CGROUP_CPU_PERIOD))
+		if err = cgroup.write("cpu.max", fmt.Sprintf("%d %d", quota, common.CGROUP_CPU_PERIOD)); err != nil {
+			return
+		}
+	}
+	if limits.MemoryMax > 0 {
+		if err = cgroup.write("memory.max", strconv.FormatInt(limits.MemoryMax, 10)); err != nil {
+			return
+		}
+	}
+	if limits.PidsMax > 0 {
+		if err = cgroup.write("pids.max", strconv.FormatInt(limits.PidsMax, 10)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 子进程启动时放入该cgroup
+func (cgroup *Cgroup) Apply(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cgroup.fd.Fd())
+}
+
+// 内存使用峰值，单位字节
+func (cgroup *Cgroup) PeakMemory() int64 {
+	value, err := cgroup.read("memory.peak")
+	if err != nil {
+		return 0
+	}
+	peak, _ := strconv.ParseInt(value, 10, 64)
+	return peak
+}
+
+// 用户态和内核态的cpu时间之和
+func (cgroup *Cgroup) CpuTime() time.Duration {
+	value, err := cgroup.read("cpu.stat")
+	if err != nil {
+		return 0
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(value))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, _ := strconv.ParseInt(fields[1], 10, 64)
+			return time.Duration(usec) * time.Microsecond
+		}
+	}
+	return 0
+}
+
+// 杀死残留的进程并删除目录
+func (cgroup *Cgroup) Remove() {
+	if cgroup.fd != nil {
+		cgroup.fd.Close()
+	}
+
+	// 命令退出后可能还有后台进程，删除前全部杀死
+	cgroup.write("cgroup.kill", "1")
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(cgroup.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (cgroup *Cgroup) write(file string, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroup.path, file), []byte(value), 0644)
+}
+
+func (cgroup *Cgroup) read(file string) (string, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(cgroup.path, file))
+	return strings.TrimSpace(string(bytes)), err
+}
@@ -2,14 +2,26 @@ package worker
 
 import (
 	"encoding/json"
+	"github.com/MrDragon1122/crontab/common"
 	"io/ioutil"
 )
 
 type Config struct {
-	EtcdEndpoints      []string `json:"etcdEndpoints"`
-	EtcdDialTimeout    int      `json:"etcdDialTimeout"`
-	MongodbUri         string   `json:"mongodbUri"`
-	MongodbDialTimeout int      `json:"mongodbDialTimeout"`
+	EtcdEndpoints      []string          `json:"etcdEndpoints"`
+	EtcdDialTimeout    int               `json:"etcdDialTimeout"`
+	MongodbUri         string            `json:"mongodbUri"`
+	MongodbDialTimeout int               `json:"mongodbDialTimeout"`
+	MaxOutputBytes     int64             `json:"maxOutputBytes"`    // 单次执行的输出上限，stdout、stderr和合并输出的总和
+	OutputSpill        bool              `json:"outputSpill"`       // 超过上限时是否把完整输出保存到GridFS
+	AllowedRunAsUsers  []string          `json:"allowedRunAsUsers"` // 任务可以切换的用户，*表示所有用户，为空不允许切换
+	CgroupRoot         string            `json:"cgroupRoot"`        // 执行资源受限任务的cgroup v2目录
+	Labels             map[string]string `json:"labels"`            // worker的标签，随注册信息上报
+	DispatchMode       string            `json:"dispatchMode"`      // 调度的分派方式 race leader，集群内需要一致
+	DispatchStrategy   string            `json:"dispatchStrategy"`  // leader选择worker的方式 leastLoaded hash
+	MaxConcurrentJobs  int               `json:"maxConcurrentJobs"` // 同时执行的任务数上限，0表示不限制
+	CapacityPolicy     string            `json:"capacityPolicy"`    // 达到上限时的处理方式 decline queue
+	DrainTimeout       int               `json:"drainTimeout"`      // 退出时等待正在执行的任务结束的时间，单位秒
+	MisfireThreshold   int               `json:"misfireThreshold"`  // 晚于计划时间超过该值认为错过了调度，单位秒
 }
 
 // 定义单例
@@ -27,6 +39,50 @@ func InitConfig(filename string) (err error) {
 		return
 	}
 
+	// 未配置输出上限时使用默认值，避免日志超过MongoDB单文档大小
+	if conf.MaxOutputBytes <= 0 {
+		conf.MaxOutputBytes = common.JOB_MAX_OUTPUT_BYTES
+	}
+	if conf.MaxOutputBytes > common.JOB_MAX_OUTPUT_BYTES_LIMIT {
+		err = common.ERR_INVALID_MAX_OUTPUT
+		return
+	}
+
+	if conf.CgroupRoot == "" {
+		conf.CgroupRoot = common.CGROUP_ROOT
+	}
+
+	// 默认每个worker抢锁执行
+	if conf.DispatchMode == "" {
+		conf.DispatchMode = common.DISPATCH_MODE_RACE
+	}
+	if conf.DispatchStrategy == "" {
+		conf.DispatchStrategy = common.DISPATCH_STRATEGY_LEAST_LOADED
+	}
+	if (conf.DispatchMode != common.DISPATCH_MODE_RACE && conf.DispatchMode != common.DISPATCH_MODE_LEADER) ||
+		(conf.DispatchStrategy != common.DISPATCH_STRATEGY_LEAST_LOADED && conf.DispatchStrategy != common.DISPATCH_STRATEGY_HASH) {
+		err = common.ERR_INVALID_DISPATCH
+		return
+	}
+
+	// 默认达到上限时放弃执行，由其他worker抢锁
+	if conf.CapacityPolicy == "" {
+		conf.CapacityPolicy = common.CAPACITY_POLICY_DECLINE
+	}
+	if conf.MaxConcurrentJobs < 0 ||
+		(conf.CapacityPolicy != common.CAPACITY_POLICY_DECLINE && conf.CapacityPolicy != common.CAPACITY_POLICY_QUEUE) {
+		err = common.ERR_INVALID_CAPACITY
+		return
+	}
+
+	if conf.DrainTimeout <= 0 {
+		conf.DrainTimeout = common.WORKER_DRAIN_TIMEOUT
+	}
+
+	if conf.MisfireThreshold <= 0 {
+		conf.MisfireThreshold = common.MISFIRE_THRESHOLD
+	}
+
 	// 初始化单例
 	G_config = &conf
 
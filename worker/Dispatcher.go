@@ -0,0 +1,435 @@
+package worker
+
+import (
+	"encoding/json"
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"traefik/log"
+)
+
+// leader分派模式：通过etcd选举出一个leader，由它把每次到期的执行分派给一个worker
+type Dispatcher struct {
+	client  *clientv3.Client
+	kv      clientv3.KV
+	lease   clientv3.Lease
+	watcher clientv3.Watcher
+
+	isLeader   int32                      // 本worker是否为leader
+	assignChan chan *common.JobAssignment // 等待分派的执行
+	stopChan   chan struct{}              // worker下线时放弃leader，不再竞选
+
+	workers     []*common.WorkerInfo // 缓存的在线worker，只在分派协程中使用
+	workersTime time.Time            // 缓存的更新时间
+}
+
+// 定义单例
+var (
+	G_dispatcher *Dispatcher
+)
+
+// 初始化分派器，调度器通过它判断是否由本worker分派
+func InitDispatcher() (err error) {
+	// 初始化etcd配置
+	config := clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,                                     // etcd集群地址
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 超时
+	}
+
+	// 建立etcd的连接
+	client, err := clientv3.New(config)
+	if err != nil {
+		return
+	}
+
+	G_dispatcher = &Dispatcher{
+		client:     client,
+		kv:         clientv3.NewKV(client),
+		lease:      clientv3.NewLease(client),
+		watcher:    clientv3.NewWatcher(client),
+		assignChan: make(chan *common.JobAssignment, 1000),
+		stopChan:   make(chan struct{}),
+	}
+
+	return
+}
+
+// 任务加载到调度器后开始竞选，当选后需要调度器从水位线补分派，race模式下不参与选举
+func StartDispatcher() {
+	if !G_dispatcher.IsLeaderMode() {
+		return
+	}
+
+	// 参与leader选举，并处理分派
+	go G_dispatcher.campaignLoop()
+	go G_dispatcher.dispatchLoop()
+	go G_dispatcher.watchWatermarks()
+	go G_dispatcher.watchReturns()
+}
+
+// 是否为leader分派模式
+func (dispatcher *Dispatcher) IsLeaderMode() bool {
+	return G_config.DispatchMode == common.DISPATCH_MODE_LEADER
+}
+
+// 本worker是否为leader
+func (dispatcher *Dispatcher) IsLeader() bool {
+	return atomic.LoadInt32(&dispatcher.isLeader) == 1
+}
+
+// 放弃leader并停止竞选，其他worker可以立即接替
+func (dispatcher *Dispatcher) Stop() {
+	close(dispatcher.stopChan)
+}
+
+// 把到期的执行交给分派协程，不阻塞调度协程
+func (dispatcher *Dispatcher) Dispatch(assignment *common.JobAssignment) {
+	dispatcher.assignChan <- assignment
+}
+
+// 竞选leader，当选后续租直到租约失效，落选则等待leader的key被删除后重新竞选
+func (dispatcher *Dispatcher) campaignLoop() {
+	for {
+		select {
+		case <-dispatcher.stopChan:
+			return
+		default:
+		}
+
+		grantResp, err := dispatcher.lease.Grant(context.Background(), common.JOB_LEADER_TTL)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		leaseID := grantResp.ID
+
+		// 自动续租
+		ctx, cancel := context.WithCancel(context.Background())
+		keepAliveChan, err := dispatcher.lease.KeepAlive(ctx, leaseID)
+		if err != nil {
+			cancel()
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		// key不存在时写入本机ip，否则读取当前的leader
+		txnResp, err := dispatcher.kv.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.CreateRevision(common.JOB_LEADER_KEY), "=", 0)).
+			Then(clientv3.OpPut(common.JOB_LEADER_KEY, G_register.localIp, clientv3.WithLease(leaseID))).
+			Else(clientv3.OpGet(common.JOB_LEADER_KEY)).
+			Commit()
+		if err != nil {
+			cancel()
+			dispatcher.lease.Revoke(context.Background(), leaseID)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		if txnResp.Succeeded {
+			atomic.StoreInt32(&dispatcher.isLeader, 1)
+			log.Infof("worker %v became dispatch leader", G_register.localIp)
+
+			// 上一个leader失效到本次当选之间的调度没有被分派
+			dispatcher.catchUp()
+
+			// 续租失败说明已经失去leader身份，worker下线时撤销租约让出leader
+		LEADER:
+			for {
+				select {
+				case keepResp := <-keepAliveChan:
+					if keepResp == nil {
+						break LEADER
+					}
+				case <-dispatcher.stopChan:
+					dispatcher.lease.Revoke(context.Background(), leaseID)
+					break LEADER
+				}
+			}
+
+			atomic.StoreInt32(&dispatcher.isLeader, 0)
+			log.Warnf("worker %v lost dispatch leader", G_register.localIp)
+			cancel()
+			continue
+		}
+
+		// 落选，释放租约
+		cancel()
+		dispatcher.lease.Revoke(context.Background(), leaseID)
+
+		dispatcher.waitLeaderGone(txnResp.Header.Revision + 1)
+	}
+}
+
+// 加载水位线，交给调度器补分派错过的调度
+func (dispatcher *Dispatcher) catchUp() {
+	getResp, err := dispatcher.kv.Get(context.Background(), common.JOB_WATERMARK_DIR, clientv3.WithPrefix())
+	if err != nil {
+		log.Errorf("load watermarks for catch up err: %v", err)
+		return
+	}
+
+	watermarks := make(map[string]time.Time)
+	for _, kv := range getResp.Kvs {
+		if planTime, err := common.DecodeWatermark(kv.Value); err == nil {
+			watermarks[common.ExtractWatermarkName(string(kv.Key))] = planTime
+		}
+	}
+
+	G_scheduler.PushJobEvent(&common.JobEvent{EventType: common.JOB_EVENT_LEADER_ELECTED, Watermarks: watermarks})
+
+	// 没有leader期间交还的执行
+	returnResp, err := dispatcher.kv.Get(context.Background(), common.JOB_ASSIGN_RETURN_DIR, clientv3.WithPrefix())
+	if err != nil {
+		log.Errorf("load returned assignments err: %v", err)
+		return
+	}
+	for _, kv := range returnResp.Kvs {
+		dispatcher.redispatch(string(kv.Key), kv.Value)
+	}
+}
+
+// 监听worker交还的执行，只有leader重新分派
+func (dispatcher *Dispatcher) watchReturns() {
+	watchChan := dispatcher.watcher.Watch(context.Background(), common.JOB_ASSIGN_RETURN_DIR, clientv3.WithPrefix())
+	for watchResp := range watchChan {
+		for _, watchEvent := range watchResp.Events {
+			if watchEvent.Type != mvccpb.PUT || !dispatcher.IsLeader() {
+				continue
+			}
+			dispatcher.redispatch(string(watchEvent.Kv.Key), watchEvent.Kv.Value)
+		}
+	}
+}
+
+// 删除交还记录成功后重新分派，当选时的加载和监听可能同时看到同一条记录
+func (dispatcher *Dispatcher) redispatch(returnKey string, value []byte) {
+	assignment, err := common.UnpackAssignment(value)
+	if err != nil || assignment.Job == nil {
+		log.Errorf("unpack returned assignment err: %v", err)
+		return
+	}
+
+	delResp, err := dispatcher.kv.Delete(context.Background(), returnKey)
+	if err != nil {
+		log.Errorf("delete returned assignment %v err: %v", assignment.RunId, err)
+		return
+	}
+	if delResp.Deleted == 0 {
+		return
+	}
+
+	log.Infof("redispatch job %v run %v declined by %v", assignment.Job.Name, assignment.RunId, assignment.Declined)
+	dispatcher.Dispatch(assignment)
+}
+
+// 监听水位线的推进，leader据此判断分派的补执行已经结束
+func (dispatcher *Dispatcher) watchWatermarks() {
+	watchChan := dispatcher.watcher.Watch(context.Background(), common.JOB_WATERMARK_DIR, clientv3.WithPrefix())
+	for watchResp := range watchChan {
+		for _, watchEvent := range watchResp.Events {
+			if watchEvent.Type != mvccpb.PUT || !dispatcher.IsLeader() {
+				continue
+			}
+			planTime, err := common.DecodeWatermark(watchEvent.Kv.Value)
+			if err != nil {
+				continue
+			}
+
+			watermarkName := common.ExtractWatermarkName(string(watchEvent.Kv.Key))
+			G_scheduler.PushJobEvent(&common.JobEvent{
+				EventType:     common.JOB_EVENT_WATERMARK,
+				Job:           &common.Job{Name: common.ExtractShardJobName(watermarkName)},
+				Watermark:     planTime,
+				WatermarkName: watermarkName,
+			})
+		}
+	}
+}
+
+// 等待当前leader的key被删除或过期
+func (dispatcher *Dispatcher) waitLeaderGone(revision int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watchChan := dispatcher.watcher.Watch(ctx, common.JOB_LEADER_KEY, clientv3.WithRev(revision))
+	for {
+		select {
+		case watchResp, ok := <-watchChan:
+			if !ok {
+				return
+			}
+			for _, watchEvent := range watchResp.Events {
+				if watchEvent.Type == mvccpb.DELETE {
+					return
+				}
+			}
+		case <-dispatcher.stopChan:
+			return
+		}
+	}
+}
+
+// 分派协程，依次为每个执行选择worker并写入etcd
+func (dispatcher *Dispatcher) dispatchLoop() {
+	for assignment := range dispatcher.assignChan {
+		if err := dispatcher.assign(assignment); err != nil {
+			log.Errorf("dispatch job %v err: %v", assignment.Job.Name, err)
+
+			// 分派失败时，标签匹配且没有拒绝过的leader自己执行
+			if !assignment.Job.MatchLabels(G_config.Labels) || assignment.IsDeclinedBy(G_register.localIp) {
+				continue
+			}
+			assignment.Worker = G_register.localIp
+			jobEvent := common.BuildJobEvent(common.JOB_EVENT_ASSIGN, assignment.Job)
+			jobEvent.Assignment = assignment
+			G_scheduler.PushJobEvent(jobEvent)
+		}
+	}
+}
+
+// 选择worker并写入/cron/assign/ip/执行ID
+func (dispatcher *Dispatcher) assign(assignment *common.JobAssignment) (err error) {
+	worker, err := dispatcher.selectWorker(assignment)
+	if err != nil {
+		return
+	}
+
+	assignment.Worker = worker
+	assignment.AssignTime = time.Now().UnixNano() / 1e6
+
+	assignValue, err := json.Marshal(assignment)
+	if err != nil {
+		return
+	}
+
+	// 分派记录设置有效期，worker没有接收时自动删除
+	leaseResp, err := dispatcher.lease.Grant(context.Background(), common.JOB_ASSIGN_TTL)
+	if err != nil {
+		return
+	}
+
+	if _, err = dispatcher.kv.Put(context.Background(), common.BuildAssignKey(assignment), string(assignValue), clientv3.WithLease(leaseResp.ID)); err != nil {
+		return
+	}
+
+	log.Infof("dispatch job %v run %v to %v", assignment.Job.Name, assignment.RunId, worker)
+	return
+}
+
+// 在标签匹配的在线worker中选择一个
+func (dispatcher *Dispatcher) selectWorker(assignment *common.JobAssignment) (worker string, err error) {
+	if err = dispatcher.refreshWorkers(); err != nil {
+		return
+	}
+
+	candidates := matchWorkers(assignment, dispatcher.workers)
+	if len(candidates) == 0 {
+		err = common.ERR_NO_DISPATCH_WORKER
+		return
+	}
+
+	// 优先分派给还有空闲槽位的worker，全部用满时在worker上排队
+	if free := freeWorkers(candidates); len(free) != 0 {
+		candidates = free
+	}
+
+	if G_config.DispatchStrategy == common.DISPATCH_STRATEGY_HASH {
+		key := assignment.Job.Name
+		if assignment.ShardTotal > 1 {
+			key = common.BuildShardName(assignment.Job.Name, assignment.ShardIndex)
+		}
+		return hashWorker(key, candidates), nil
+	}
+
+	// 正在执行的任务数最少的worker，相同时比较负载
+	selected := candidates[0]
+	for _, workerInfo := range candidates[1:] {
+		if workerInfo.Running < selected.Running ||
+			(workerInfo.Running == selected.Running && workerInfo.Load[0] < selected.Load[0]) {
+			selected = workerInfo
+		}
+	}
+
+	// 缓存刷新前，同一批分派不集中到一个worker
+	selected.Running++
+	selected.UsedSlots++
+	return selected.Ip, nil
+}
+
+// 标签匹配且没有拒绝过本次执行的worker
+func matchWorkers(assignment *common.JobAssignment, workers []*common.WorkerInfo) (candidates []*common.WorkerInfo) {
+	for _, workerInfo := range workers {
+		if assignment.Job.MatchLabels(workerInfo.Labels) && !assignment.IsDeclinedBy(workerInfo.Ip) {
+			candidates = append(candidates, workerInfo)
+		}
+	}
+	return
+}
+
+// 执行槽位没有用满的worker
+func freeWorkers(workers []*common.WorkerInfo) (free []*common.WorkerInfo) {
+	for _, workerInfo := range workers {
+		if workerInfo.MaxSlots == 0 || workerInfo.UsedSlots < workerInfo.MaxSlots {
+			free = append(free, workerInfo)
+		}
+	}
+	return
+}
+
+// 按上报周期刷新在线worker
+func (dispatcher *Dispatcher) refreshWorkers() (err error) {
+	if dispatcher.workers != nil && time.Since(dispatcher.workersTime) < common.WORKER_REPORT_INTERVAL {
+		return
+	}
+
+	getResp, err := dispatcher.kv.Get(context.Background(), common.JOB_WORKER_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	workers := make([]*common.WorkerInfo, 0, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		workerInfo := &common.WorkerInfo{}
+		if len(kv.Value) != 0 {
+			if e := json.Unmarshal(kv.Value, workerInfo); e != nil {
+				log.Errorf("unpack worker info err: %v", e)
+			}
+		}
+		workerInfo.Ip = common.ExtractWorkerIp(string(kv.Key))
+		workers = append(workers, workerInfo)
+	}
+
+	dispatcher.workers = workers
+	dispatcher.workersTime = time.Now()
+	return
+}
+
+// 一致性哈希，worker上下线时只有少量任务改变执行的worker
+func hashWorker(key string, candidates []*common.WorkerInfo) string {
+	type node struct {
+		hash uint32
+		ip   string
+	}
+
+	ring := make([]node, 0, len(candidates)*common.DISPATCH_HASH_REPLICAS)
+	for _, workerInfo := range candidates {
+		for i := 0; i < common.DISPATCH_HASH_REPLICAS; i++ {
+			ring = append(ring, node{crc32.ChecksumIEEE([]byte(workerInfo.Ip + "#" + strconv.Itoa(i))), workerInfo.Ip})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	// 顺时针找到第一个虚拟节点
+	hash := crc32.ChecksumIEEE([]byte(key))
+	index := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if index == len(ring) {
+		index = 0
+	}
+	return ring[index].ip
+}
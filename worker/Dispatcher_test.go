@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"github.com/MrDragon1122/crontab/common"
+	"strconv"
+	"testing"
+)
+
+func buildHashWorkers(ips ...string) []*common.WorkerInfo {
+	workers := make([]*common.WorkerInfo, 0, len(ips))
+	for _, ip := range ips {
+		workers = append(workers, &common.WorkerInfo{Ip: ip})
+	}
+	return workers
+}
+
+func TestHashWorkerStable(t *testing.T) {
+	workers := buildHashWorkers("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	reversed := buildHashWorkers("10.0.0.4", "10.0.0.3", "10.0.0.2", "10.0.0.1")
+	removed := buildHashWorkers("10.0.0.1", "10.0.0.2", "10.0.0.4")
+	added := buildHashWorkers("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5")
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := "job" + strconv.Itoa(i)
+		selected := hashWorker(key, workers)
+		counts[selected]++
+
+		// 与worker的顺序无关
+		if got := hashWorker(key, reversed); got != selected {
+			t.Fatalf("hashWorker(%v) = %v with reversed workers, want %v", key, got, selected)
+		}
+
+		// worker下线只影响分派给它的任务
+		if got := hashWorker(key, removed); selected != "10.0.0.3" && got != selected {
+			t.Fatalf("hashWorker(%v) moved from %v to %v after another worker left", key, selected, got)
+		}
+
+		// worker上线只会把任务分派给新worker
+		if got := hashWorker(key, added); got != selected && got != "10.0.0.5" {
+			t.Fatalf("hashWorker(%v) moved from %v to %v after a worker joined", key, selected, got)
+		}
+	}
+
+	// 虚拟节点让任务大致均匀
+	for _, workerInfo := range workers {
+		if counts[workerInfo.Ip] < 100 {
+			t.Errorf("worker %v got %v of 1000 keys", workerInfo.Ip, counts[workerInfo.Ip])
+		}
+	}
+}
+
+func TestMatchWorkersSkipsDeclined(t *testing.T) {
+	workers := buildHashWorkers("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	workers[2].Labels = map[string]string{"zone": "b"}
+
+	assignment := &common.JobAssignment{
+		Job: &common.Job{
+			Name:         "job",
+			NodeSelector: []*common.LabelRequirement{{Key: "zone", Operator: common.LABEL_OPERATOR_NOT_IN, Values: []string{"b"}}},
+		},
+		Declined: []string{"10.0.0.1"},
+	}
+
+	candidates := matchWorkers(assignment, workers)
+	if len(candidates) != 1 || candidates[0].Ip != "10.0.0.2" {
+		t.Fatalf("matchWorkers() = %v, want only 10.0.0.2", candidates)
+	}
+
+	// 所有匹配的worker都拒绝过，不再分派
+	assignment.Declined = append(assignment.Declined, "10.0.0.2")
+	if candidates := matchWorkers(assignment, workers); len(candidates) != 0 {
+		t.Fatalf("matchWorkers() = %v, want none", candidates)
+	}
+}
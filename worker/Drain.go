@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"github.com/MrDragon1122/crontab/common"
+	"sync/atomic"
+	"time"
+	"traefik/log"
+)
+
+var (
+	draining  int32                         // worker是否正在下线
+	drainChan = make(chan time.Duration, 1) // master的下线请求，值为等待时间
+)
+
+// worker是否正在下线
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// 请求下线，timeout为0时使用配置的等待时间
+func RequestDrain(timeout time.Duration) {
+	select {
+	case drainChan <- timeout:
+	default:
+		// 已经有下线请求
+	}
+}
+
+// 等待master的下线请求
+func DrainRequested() <-chan time.Duration {
+	return drainChan
+}
+
+// 下线：不再执行新任务，注销节点，等待正在执行的任务结束，超时后强杀，最后写完缓存的日志
+func Drain(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		return
+	}
+	if timeout <= 0 {
+		timeout = time.Duration(G_config.DrainTimeout) * time.Second
+	}
+	log.Infof("worker %v draining, wait %v for running jobs", G_register.localIp, timeout)
+
+	// 放弃leader，注销节点，master和leader不再把执行分派给本worker
+	G_dispatcher.Stop()
+	if G_register.Deregister(common.WORKER_DEREGISTER_TIMEOUT) {
+		log.Info("worker deregistered")
+	} else {
+		log.Warnf("deregister worker timeout after %v, wait for lease expiry", common.WORKER_DEREGISTER_TIMEOUT)
+	}
+
+	// 执行结束时释放锁并把日志交给LogSink
+	if !G_scheduler.WaitIdle(time.Now().Add(timeout)) {
+		log.Warnf("running jobs not finished after %v, kill them", timeout)
+		G_scheduler.PushJobEvent(&common.JobEvent{EventType: common.JOB_EVENT_KILL_ALL})
+
+		if !G_scheduler.WaitIdle(time.Now().Add(common.WORKER_DRAIN_KILL_WAIT)) {
+			log.Errorf("running jobs not finished after kill, exit anyway")
+		}
+	}
+
+	if !G_logsink.Flush(common.WORKER_DRAIN_FLUSH_TIMEOUT) {
+		log.Errorf("flush job logs timeout")
+	}
+	log.Info("worker drained")
+}
@@ -2,13 +2,21 @@ package worker
 
 import (
 	"github.com/MrDragon1122/crontab/common"
+	"io"
 	"math/rand"
+	"os"
 	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"traefik/log"
 )
 
 // 任务执行器
 type Executor struct {
+	running int64         // 正在执行的任务数，包括等待锁和重试的
+	slots   chan struct{} // 执行槽位，容量为maxConcurrentJobs，不限制时为空；抢到锁之后占用，等锁和重试退避期间不占用
 }
 
 // 定义单例
@@ -19,53 +27,669 @@ var (
 // 初始化执行器
 func InitExecutor() (err error) {
 	G_executor = &Executor{}
+
+	if G_config.MaxConcurrentJobs > 0 {
+		G_executor.slots = make(chan struct{}, G_config.MaxConcurrentJobs)
+	}
 	return
 }
 
-// 执行任务
-func (executor *Executor) ExecuteJob(info *common.JobExecuteInfo) {
+// 执行任务，槽位用满且按decline策略放弃时返回ERR_WORKER_SATURATED，其他worker可以抢到锁执行
+// worker下线中返回ERR_WORKER_DRAINING
+// leader分派的执行已经选定本worker，总是排队等待
+func (executor *Executor) ExecuteJob(info *common.JobExecuteInfo) (err error) {
+	// 下线中的worker不再执行新任务
+	if IsDraining() {
+		return common.ERR_WORKER_DRAINING
+	}
+
+	// 槽位在抢到锁之后才占用，这里只检查是否已经用满
+	if executor.isSaturated() && G_config.CapacityPolicy == common.CAPACITY_POLICY_DECLINE && !info.IsAssigned {
+		return common.ERR_WORKER_SATURATED
+	}
+
 	// 实现真正的随机数
 	rand.Seed(time.Now().UnixNano())
 	go func() {
-		//任务执行结果
-		result := &common.JobExecuteResult{
-			ExecuteInfo: info,
-			Output:      make([]byte, 0),
-		}
+		atomic.AddInt64(&executor.running, 1)
+		defer atomic.AddInt64(&executor.running, -1)
 
-		// 随机睡眠 解决由于服务器时钟不一致导致的，分布式不均匀的问题
-		time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+		// 锁、槽位和触发状态在runJob返回前处理完，调度器收到结果时执行已经完全结束
+		// worker下线时等到执行表为空即可退出，不会遗留没有释放的锁
+		result := executor.runJob(info)
 
-		// 首先获取分布式锁
-		jobLock := G_jobMgr.CreateJobLock(info.Job.Name)
+		// 任务执行完成后，把执行的结果返回给Scheduler，Scheduler从ExecutingTable中删除执行记录
+		executor.finishJob(info, result)
+	}()
+
+	return
+}
 
-		// 记录任务开始时间
-		result.StartTime = time.Now()
+// 抢锁并执行任务，返回最终结果
+func (executor *Executor) runJob(info *common.JobExecuteInfo) (result *common.JobExecuteResult) {
+	//任务执行结果
+	result = &common.JobExecuteResult{
+		ExecuteInfo: info,
+		Output:      make([]byte, 0),
+	}
 
-		// 抢占分布式锁
-		err := jobLock.TryLock()
-		defer jobLock.Unlock()
+	// 随机睡眠 解决由于服务器时钟不一致导致的，分布式不均匀的问题
+	// leader分派的执行已经选定了worker，不需要随机睡眠
+	if !info.IsAssigned {
+		time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+	}
 
-		if err != nil { // 上锁失败
+	// 手动触发的任务先认领，保证只有一个worker等锁和执行；广播任务每个worker都执行
+	claimed := info.Trigger != nil && !info.Job.IsBroadcast()
+	if claimed {
+		if err := G_jobMgr.ClaimTrigger(info.Trigger); err != nil {
 			result.Err = err
 			result.EndTime = time.Now()
-		} else {
-			// 上锁成功后，重置任务开始时间
-			result.StartTime = time.Now()
+			return
+		}
+	}
+
+	// 记录任务开始时间
+	result.StartTime = time.Now()
+
+	// 按并发策略抢占分布式锁，抢到锁之后再占用执行槽位，槽位用满时排队，期间任务可能被强杀
+	jobLock, err := executor.lockJob(info)
+	defer jobLock.Unlock()
 
-			// 执行shell命令
-			cmd := exec.CommandContext(info.CommandCtx, "/bin/bash", "-c", info.Job.Command)
+	holdSlot := false
+	defer func() {
+		if holdSlot {
+			executor.releaseSlot()
+		}
+	}()
+	if err == nil {
+		if err = executor.acquireSlot(info); err == nil {
+			holdSlot = true
+		}
+	}
+
+	if err != nil { // 上锁失败，或者排队等待槽位时被强杀
+		// 已认领的触发请求不会再被其他worker执行，告知调用方没有执行
+		if claimed {
+			status := common.TRIGGER_STATUS_EXPIRED
+			if info.CommandCtx.Err() != nil {
+				status = common.TRIGGER_STATUS_CANCELED
+			}
+			log.Warnf("job %v trigger %v not executed: %v", info.Job.Name, info.Trigger.TriggerId, err)
+			G_jobMgr.UpdateTriggerStatus(info.Trigger, status, err)
+		}
 
-			// 执行并捕获输出
-			output, err := cmd.CombinedOutput()
+		result.Err = err
+		result.EndTime = time.Now()
+		return
+	}
 
-			// 记录任务结束时间
+	if claimed {
+		G_jobMgr.UpdateTriggerStatus(info.Trigger, common.TRIGGER_STATUS_RUNNING, nil)
+		defer G_jobMgr.UpdateTriggerStatus(info.Trigger, common.TRIGGER_STATUS_DONE, nil)
+	}
+
+	// 补执行和排队等锁的执行，确认该计划时间没有被其他worker成功执行过
+	if (info.IsMisfire || info.Job.ConcurrencyPolicy == common.CONCURRENCY_POLICY_QUEUE) &&
+		info.Trigger == nil && !info.Job.IsBroadcast() {
+		if watermark, err := G_jobMgr.GetWatermark(info.GetWatermarkName()); err == nil && !watermark.Before(info.PlanTime) {
+			result.Err = common.ERR_FIRE_ALREADY_DONE
 			result.EndTime = time.Now()
-			result.Output = output
-			result.Err = err
+			return
 		}
+	}
 
-		// 任务执行完成后，把执行的结果返回给Scheduler，Scheduler从ExecutingTable中删除执行记录
+	// 上锁成功后执行，失败时在持有锁的情况下按策略重试
+	for attempt := 1; ; attempt++ {
+		result = executor.executeAttempt(info, attempt)
+
+		// 成功、不满足重试条件或者任务被强杀，结束执行
+		if result.Err == nil || info.CommandCtx.Err() != nil ||
+			!info.Job.Retry.ShouldRetry(attempt, result.ExitCode) {
+			break
+		}
+
+		// 回传本次尝试的结果，任务仍在执行表中
+		result.IsRetrying = true
 		G_scheduler.PushJobResult(result)
+
+		backoff := info.Job.Retry.GetBackoff(attempt)
+		log.Infof("job %v attempt %v failed: %v, retry after %v", info.Job.Name, attempt, result.Err, backoff)
+		if claimed {
+			G_jobMgr.UpdateTriggerRetry(info.Trigger, time.Now().Add(backoff))
+		}
+
+		// 退避期间释放槽位，其他任务可以执行；等待重试期间任务可能被强杀
+		executor.releaseSlot()
+		holdSlot = false
+		select {
+		case <-time.After(backoff):
+			if executor.acquireSlot(info) == nil {
+				holdSlot = true
+				continue
+			}
+		case <-info.CommandCtx.Done():
+		}
+		result = &common.JobExecuteResult{
+			ExecuteInfo: info,
+			Err:         common.ERR_JOB_RETRY_CANCELED,
+			EndTime:     time.Now(),
+		}
+		break
+	}
+
+	// 水位线记录最近一次成功执行的计划时间
+	if result.AdvancesWatermark() {
+		if err := G_jobMgr.SaveWatermark(info.GetWatermarkName(), info.PlanTime); err != nil {
+			log.Errorf("save job %v watermark err: %v", info.Job.Name, err)
+		}
+	}
+
+	return
+}
+
+// 正在执行的任务数
+func (executor *Executor) RunningCount() int {
+	return int(atomic.LoadInt64(&executor.running))
+}
+
+// 占用的执行槽位数和上限，上限为0表示不限制
+func (executor *Executor) SlotUsage() (used int, max int) {
+	return len(executor.slots), cap(executor.slots)
+}
+
+// 执行槽位是否已经用满，不占用槽位
+func (executor *Executor) isSaturated() bool {
+	return executor.slots != nil && len(executor.slots) == cap(executor.slots)
+}
+
+// 占用一个执行槽位，用满时排队等待，任务被强杀时放弃
+func (executor *Executor) acquireSlot(info *common.JobExecuteInfo) (err error) {
+	if executor.tryAcquireSlot() {
+		return
+	}
+	return executor.waitSlot(info)
+}
+
+// 尝试占用一个执行槽位，不等待
+func (executor *Executor) tryAcquireSlot() bool {
+	if executor.slots == nil {
+		return true
+	}
+
+	select {
+	case executor.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// 等待空闲的执行槽位，任务被强杀时放弃
+func (executor *Executor) waitSlot(info *common.JobExecuteInfo) (err error) {
+	log.Infof("worker saturated, job %v run %v waits for a free slot", info.Job.Name, info.RunId)
+
+	select {
+	case executor.slots <- struct{}{}:
+		return
+	case <-info.CommandCtx.Done():
+		return common.ERR_JOB_QUEUE_CANCELED
+	}
+}
+
+// 释放执行槽位
+func (executor *Executor) releaseSlot() {
+	if executor.slots == nil {
+		return
+	}
+	<-executor.slots
+}
+
+// 回传最终结果，被强杀的执行先向master确认
+func (executor *Executor) finishJob(info *common.JobExecuteInfo, result *common.JobExecuteResult) {
+	// 每个需要确认的强杀请求各回写一次
+	for _, killer := range info.GetKillers() {
+		if killer.KillId == "" {
+			continue
+		}
+		ack := &common.KillAck{
+			KillId:   killer.KillId,
+			JobName:  info.Job.Name,
+			Worker:   G_register.localIp,
+			Running:  true,
+			RunId:    info.RunId,
+			Pid:      result.Pid,
+			KillTime: time.Now().UnixNano() / 1e6,
+		}
+		if result.Err == common.ERR_KILL_NOT_CONFIRMED {
+			ack.Err = result.Err.Error()
+		}
+		if err := G_jobMgr.AckKill(ack); err != nil {
+			log.Errorf("ack kill %v of job %v err: %v", ack.KillId, ack.JobName, err)
+		}
+	}
+
+	G_scheduler.PushJobResult(result)
+}
+
+// 按任务的并发策略抢占分布式锁，锁的值为本次执行ID
+func (executor *Executor) lockJob(info *common.JobExecuteInfo) (jobLock *JobLock, err error) {
+	job := info.Job
+
+	// 广播任务每个worker一把锁，并发策略只在本worker内生效；分片任务每个分片一把锁
+	lockName := job.Name
+	if job.IsBroadcast() {
+		lockName = common.BuildWorkerLockName(job.Name, G_register.localIp)
+	} else if info.IsSharded() {
+		lockName = common.BuildShardName(job.Name, info.ShardIndex)
+	}
+
+	lockValue := common.BuildJobLockValue(info)
+
+	// cron调度先认领本次调度，认领在执行结束后保留一段时间，
+	// 还在随机睡眠的worker晚到时不会重复执行；手动触发已经由ClaimTrigger认领
+	if info.Trigger == nil {
+		claim := G_jobMgr.CreateFireClaim(job.Name, common.BuildFireLockKey(lockName, info.PlanTime), lockValue)
+		if err = claim.TryLock(); err != nil {
+			if err == common.ERR_LOCK_ALREADY_REQUIRED {
+				err = common.ERR_FIRE_ALREADY_CLAIMED
+			}
+			jobLock = claim
+			return
+		}
+		defer func() { jobLock.claim = claim }()
+	}
+
+	switch job.ConcurrencyPolicy {
+	case common.CONCURRENCY_POLICY_ALLOW:
+		// 不限制并发，不需要锁
+		if job.MaxParallel <= 0 {
+			jobLock = G_jobMgr.CreateJobLock(job.Name, nil, lockValue)
+			return
+		}
+
+		// 抢占一个空闲的并发槽位，槽位全部被占用说明达到并发上限
+		for slot := 0; slot < job.MaxParallel; slot++ {
+			jobLock = G_jobMgr.CreateJobLock(job.Name, []string{common.BuildSlotLockKey(lockName, slot)}, lockValue)
+			if err = jobLock.TryLock(); err != common.ERR_LOCK_ALREADY_REQUIRED && err != common.ERR_NO_FREE_SLOT {
+				return
+			}
+		}
+		err = common.ERR_NO_FREE_SLOT
+	case common.CONCURRENCY_POLICY_REPLACE:
+		jobLock = G_jobMgr.CreateJobLock(job.Name, []string{common.BuildJobLockKey(lockName)}, lockValue)
+
+		// 手动触发的任务在触发请求有效期内等待
+		deadline := time.Now().Add(job.GetKillGracePeriod() + common.REPLACE_WAIT_TIMEOUT)
+		if info.Trigger != nil {
+			deadline = info.PlanTime.Add(common.JOB_TRIGGER_TTL * time.Second)
+		}
+		err = executor.replaceLock(info, jobLock, deadline)
+	case common.CONCURRENCY_POLICY_QUEUE:
+		// 已经认领本次调度，同一次调度只有一个worker排队，一直等到上一次执行结束
+		jobLock = G_jobMgr.CreateJobLock(job.Name, []string{common.BuildJobLockKey(lockName)}, lockValue)
+		err = executor.waitLock(info, jobLock, time.Time{})
+	default:
+		jobLock = G_jobMgr.CreateJobLock(job.Name, []string{common.BuildJobLockKey(lockName)}, lockValue)
+
+		// 手动触发的任务在触发请求有效期内等待上一次执行结束
+		if info.Trigger != nil {
+			err = executor.waitLock(info, jobLock, info.PlanTime.Add(common.JOB_TRIGGER_TTL*time.Second))
+			return
+		}
+		err = jobLock.TryLock()
+	}
+
+	return
+}
+
+// Replace策略：杀死计划时间更早的cron执行并等待它释放锁
+// 同一次或更晚的调度已经在执行时放弃；手动触发的执行不会被替换，cron调度放弃，手动触发等待它结束
+func (executor *Executor) replaceLock(info *common.JobExecuteInfo, jobLock *JobLock, deadline time.Time) (err error) {
+	var killed string // 已经发出强杀的执行ID
+
+	for {
+		if err = jobLock.TryLock(); err != common.ERR_LOCK_ALREADY_REQUIRED {
+			return
+		}
+
+		holder := jobLock.holder
+		if holder.PlanTime >= info.PlanTime.UnixNano()/1e6 {
+			return
+		}
+
+		if holder.Trigger != common.JOB_TRIGGER_CRON {
+			if info.Trigger == nil {
+				return
+			}
+		} else if holder.RunId != killed {
+			log.Infof("job %v is running as %v, replace it", info.Job.Name, holder.RunId)
+			if err = G_jobMgr.KillJob(info.Job.Name, holder.RunId); err != nil {
+				return
+			}
+			killed = holder.RunId
+		}
+
+		if time.Now().After(deadline) {
+			return
+		}
+
+		select {
+		case <-info.CommandCtx.Done():
+			return
+		case <-time.After(common.LOCK_WAIT_INTERVAL):
+		}
+	}
+}
+
+// 轮询等待锁释放，deadline为空表示一直等待，任务被强杀时放弃
+func (executor *Executor) waitLock(info *common.JobExecuteInfo, jobLock *JobLock, deadline time.Time) (err error) {
+	for {
+		if err = jobLock.TryLock(); err != common.ERR_LOCK_ALREADY_REQUIRED {
+			return
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+
+		select {
+		case <-info.CommandCtx.Done():
+			return
+		case <-time.After(common.LOCK_WAIT_INTERVAL):
+		}
+	}
+}
+
+// 执行一次任务命令
+func (executor *Executor) executeAttempt(info *common.JobExecuteInfo, attempt int) (result *common.JobExecuteResult) {
+	result = &common.JobExecuteResult{
+		ExecuteInfo: info,
+		RunId:       info.RunId,
+		Attempt:     attempt,
+		StartTime:   time.Now(),
+	}
+
+	// 重试的尝试使用新的执行ID，并关联首次执行
+	if attempt > 1 {
+		result.RunId = common.BuildRunId()
+		result.ParentRunId = info.RunId
+	}
+
+	// 构建命令及其执行环境，不允许的执行身份直接失败
+	cmd, err := executor.buildCommand(info, result)
+	if err != nil {
+		log.Errorf("job %v build command err: %v", info.Job.Name, err)
+		result.Err = err
+		result.ExitCode = -1
+	} else {
+		// 执行并捕获输出
+		executor.runCommand(info, cmd, result)
+	}
+
+	// 记录任务结束时间
+	result.EndTime = time.Now()
+
+	return
+}
+
+// 按任务配置构建命令：shell执行command或者直接执行args，并注入环境变量和工作目录
+func (executor *Executor) buildCommand(info *common.JobExecuteInfo, result *common.JobExecuteResult) (cmd *exec.Cmd, err error) {
+	job := info.Job
+	trigger := info.Trigger
+
+	// 切换执行身份
+	credential, runAsUser, err := resolveRunAs(job)
+	if err != nil {
+		return
+	}
+
+	if len(job.Args) != 0 {
+		// 不经过shell，手动触发的参数直接追加
+		args := job.Args[1:]
+		if trigger != nil && len(trigger.Args) != 0 {
+			args = append(append([]string{}, args...), trigger.Args...)
+		}
+		cmd = exec.Command(job.Args[0], args...)
+	} else {
+		cmd = exec.Command(job.GetShell(), "-c", job.Command)
+
+		// 手动触发的参数，shell命令中通过$1 $2...引用，$0为任务名
+		if trigger != nil && len(trigger.Args) != 0 {
+			cmd.Args = append(append(cmd.Args, job.Name), trigger.Args...)
+		}
+	}
+
+	cmd.Dir = job.WorkingDir
+
+	shardTotal := 1
+	if info.IsSharded() {
+		shardTotal = info.ShardTotal
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+
+	// 继承worker的环境变量，依次追加任务、手动触发的变量，最后是注入的变量，同名的以后面的为准
+	cmd.Env = os.Environ()
+	if runAsUser != nil {
+		cmd.Env = append(cmd.Env, "HOME="+runAsUser.HomeDir, "USER="+runAsUser.Username, "LOGNAME="+runAsUser.Username)
+	}
+	for key, value := range job.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	if trigger != nil {
+		for key, value := range trigger.Env {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		common.JOB_ENV_JOB_NAME+"="+job.Name,
+		common.JOB_ENV_PLAN_TIME+"="+info.PlanTime.Format(time.RFC3339),
+		common.JOB_ENV_RUN_ID+"="+result.RunId,
+		common.JOB_ENV_ATTEMPT+"="+strconv.Itoa(result.Attempt),
+		common.JOB_ENV_TRIGGER+"="+info.GetTriggerType(),
+		common.JOB_ENV_SHARD_INDEX+"="+strconv.Itoa(info.ShardIndex),
+		common.JOB_ENV_SHARD_TOTAL+"="+strconv.Itoa(shardTotal),
+	)
+
+	return
+}
+
+// 启动命令并等待结束，超时或者被强杀时结束整个进程组
+func (executor *Executor) runCommand(info *common.JobExecuteInfo, cmd *exec.Cmd, result *common.JobExecuteResult) {
+	var err error
+
+	// 输出大小限制是整条日志的总和：合并输出占一半，stdout和stderr各占四分之一，超出后只保留头部和尾部
+	maxOutputBytes := getMaxOutputBytes(info.Job)
+	stdout := NewOutputBuffer(maxOutputBytes / 4)
+	stderr := NewOutputBuffer(maxOutputBytes / 4)
+	combined := NewOutputBuffer(maxOutputBytes / 2)
+	combinedWriter := io.Writer(combined)
+
+	// 开启溢出存储时，合并输出超过上限后把完整输出保存到GridFS
+	var spill *OutputSpill
+	if G_config.OutputSpill {
+		spill = NewOutputSpill(result.RunId, maxOutputBytes/2)
+		combinedWriter = io.MultiWriter(combined, spill)
+	}
+
+	// 执行过程中实时投递输出
+	logStream := NewLogStream(info.Job.Name, result.RunId, maxOutputBytes)
+	defer logStream.Close()
+
+	// stdout和stderr分别保存，同时按写入顺序合并一份
+	cmd.Stdout = io.MultiWriter(stdout, combinedWriter, logStream.Writer(common.LOG_STREAM_STDOUT))
+	cmd.Stderr = io.MultiWriter(stderr, combinedWriter, logStream.Writer(common.LOG_STREAM_STDERR))
+
+	// 子进程单独一个会话和进程组，信号可以发给bash派生的所有子孙进程
+	// 不使用CommandContext，它只会杀死bash本身
+	cmd.SysProcAttr.Setsid = true
+
+	// bash退出后，后台运行的子孙进程可能一直持有输出管道，超过等待时间后关闭管道，Wait不再阻塞
+	cmd.WaitDelay = common.JOB_OUTPUT_WAIT_DELAY
+
+	// 未能启动的命令没有退出码
+	result.ExitCode = -1
+
+	// 配置了资源限制的任务放入单独的cgroup，无法创建时不执行
+	var cgroup *Cgroup
+	if !info.Job.Resources.IsEmpty() {
+		if cgroup, err = NewCgroup(result.RunId, info.Job.Resources); err != nil {
+			result.Err = err
+			return
+		}
+		defer cgroup.Remove()
+		cgroup.Apply(cmd.SysProcAttr)
+	}
+
+	// 启动前已经被强杀
+	if err = info.CommandCtx.Err(); err != nil {
+		result.Err = err
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		result.Err = err
+		return
+	}
+
+	result.Pid = cmd.Process.Pid
+
+	// 发布到etcd，master可以查询集群中正在执行的任务
+	unpublish := G_jobMgr.PublishRunning(&common.RunningJob{
+		JobName:      info.Job.Name,
+		RunId:        info.RunId,
+		AttemptRunId: result.RunId,
+		Worker:       G_register.localIp,
+		Pid:          result.Pid,
+		Attempt:      result.Attempt,
+		Trigger:      info.GetTriggerType(),
+		PlanTime:     info.PlanTime.UnixNano() / 1e6,
+		StartTime:    time.Now().UnixNano() / 1e6,
+	})
+	defer unpublish()
+
+	waitChan := make(chan error, 1)
+	go func() {
+		waitChan <- cmd.Wait()
 	}()
+
+	// 未配置超时的任务只等待结束或者强杀
+	var timeoutChan <-chan time.Time
+	if info.Job.Timeout > 0 {
+		timeoutTimer := time.NewTimer(time.Duration(info.Job.Timeout) * time.Second)
+		defer timeoutTimer.Stop()
+		timeoutChan = timeoutTimer.C
+	}
+
+	select {
+	case err = <-waitChan:
+		// bash已经正常退出，只是输出管道被后台进程占用，按bash的退出码计算结果
+		if err == exec.ErrWaitDelay {
+			log.Warnf("job %v run %v exited but background processes still hold its output", info.Job.Name, result.RunId)
+			err = nil
+		}
+	case <-timeoutChan:
+		result.IsTimeout = true
+		log.Infof("job %v timeout after %vs, kill process group", info.Job.Name, info.Job.Timeout)
+		if err = executor.killProcessGroup(info, cmd.Process.Pid, waitChan); err != common.ERR_KILL_NOT_CONFIRMED {
+			err = common.ERR_JOB_EXECUTE_TIMEOUT
+		}
+	case <-info.CommandCtx.Done():
+		log.Infof("job %v run %v killed, kill process group", info.Job.Name, result.RunId)
+		if err = executor.killProcessGroup(info, cmd.Process.Pid, waitChan); err != common.ERR_KILL_NOT_CONFIRMED {
+			err = common.ERR_JOB_KILLED
+			if info.IsReplaced() {
+				err = common.ERR_JOB_REPLACED
+			}
+		}
+	}
+
+	result.Err = err
+	result.Output = combined.Bytes()
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	result.OutputSize = combined.Size()
+	result.IsTruncated = combined.IsTruncated()
+	result.IsSpilled = spill != nil && spill.Close()
+
+	// 退出码和终止信号
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			result.Signal = status.Signal().String()
+		}
+	}
+
+	// 资源使用，cgroup统计包括所有子孙进程，没有cgroup时使用rusage
+	if cgroup != nil {
+		result.PeakMemory = cgroup.PeakMemory()
+		result.CpuTime = cgroup.CpuTime()
+	}
+	if cmd.ProcessState != nil {
+		if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+			if result.PeakMemory == 0 {
+				result.PeakMemory = rusage.Maxrss * 1024 // linux下单位是KB
+			}
+			if result.CpuTime == 0 {
+				result.CpuTime = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+			}
+		}
+	}
+}
+
+// 结束整个进程组：先SIGTERM，宽限期后仍未退出则SIGKILL，最后确认组内进程全部退出
+// 返回命令的退出结果，确认超时返回ERR_KILL_NOT_CONFIRMED
+func (executor *Executor) killProcessGroup(info *common.JobExecuteInfo, pgid int, waitChan chan error) (err error) {
+	syscall.Kill(-pgid, syscall.SIGTERM)
+
+	graceTimer := time.NewTimer(info.Job.GetKillGracePeriod())
+	defer graceTimer.Stop()
+
+	// bash先退出时，组内可能还有子孙进程忽略了SIGTERM，同样需要SIGKILL
+	select {
+	case err = <-waitChan:
+		if waitProcessGroupExit(pgid, graceTimer.C) {
+			return
+		}
+		log.Infof("job %v descendants still alive after grace period, send SIGKILL", info.Job.Name)
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	case <-graceTimer.C:
+		log.Infof("job %v still alive after grace period, send SIGKILL", info.Job.Name)
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		err = <-waitChan
+	}
+
+	// 等待内核回收组内的进程
+	confirmTimer := time.NewTimer(common.JOB_KILL_CONFIRM_TIMEOUT)
+	defer confirmTimer.Stop()
+	if !waitProcessGroupExit(pgid, confirmTimer.C) {
+		log.Errorf("job %v process group %v still alive after SIGKILL", info.Job.Name, pgid)
+		return common.ERR_KILL_NOT_CONFIRMED
+	}
+
+	return
+}
+
+// 轮询等待进程组内的进程全部退出，超时返回false
+func waitProcessGroupExit(pgid int, timeout <-chan time.Time) bool {
+	for isProcessGroupAlive(pgid) {
+		select {
+		case <-timeout:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// 进程组内是否还有进程
+func isProcessGroupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) != syscall.ESRCH
+}
+
+// 任务输出上限，任务配置只能比全局配置更小
+func getMaxOutputBytes(job *common.Job) int64 {
+	if job.MaxOutputBytes > 0 && job.MaxOutputBytes < G_config.MaxOutputBytes {
+		return job.MaxOutputBytes
+	}
+	return G_config.MaxOutputBytes
 }
@@ -11,25 +11,35 @@ type JobLock struct {
 	kv    clientv3.KV
 	lease clientv3.Lease
 
-	jobName    string             // 任务名
-	cancelFunc context.CancelFunc // 取消续租
-	leaseId    clientv3.LeaseID   // 租约ID
-	isLocked   bool               // 是否上锁成功
+	jobName    string               // 任务名
+	lockKeys   []string             // 锁路径，全部抢到才算上锁成功
+	value      string               // 锁的值，记录持有锁的执行
+	holder     *common.JobLockValue // 抢锁失败时，持有第一把锁的执行
+	claim      *JobLock             // 同一次调度的认领锁，随本锁一起释放
+	ttl        int64                // 租约有效期，单位秒
+	keepLease  bool                 // 释放时只停止续租，锁在租约过期后才删除
+	cancelFunc context.CancelFunc   // 取消续租
+	leaseId    clientv3.LeaseID     // 租约ID
+	isLocked   bool                 // 是否上锁成功
 }
 
 // 初始化一把锁
-func InitJobLock(jobName string, kv clientv3.KV, lease clientv3.Lease) (jobLock *JobLock) {
+func InitJobLock(jobName string, lockKeys []string, value string, kv clientv3.KV, lease clientv3.Lease) (jobLock *JobLock) {
 	return &JobLock{
-		kv:      kv,
-		lease:   lease,
-		jobName: jobName,
+		kv:       kv,
+		lease:    lease,
+		jobName:  jobName,
+		lockKeys: lockKeys,
+		value:    value,
+		ttl:      common.JOB_LOCK_TTL,
 	}
 }
 
 // 尝试上锁
+// 第一把锁被占用返回ERR_LOCK_ALREADY_REQUIRED，其余的锁被占用返回ERR_NO_FREE_SLOT
 func (jobLock *JobLock) TryLock() (err error) {
-	// 1 创建租约（5s，防止节点down，无法释放锁）
-	leaseGrantResp, err := jobLock.lease.Grant(context.Background(), 5)
+	// 1 创建租约（防止节点down，无法释放锁）
+	leaseGrantResp, err := jobLock.lease.Grant(context.Background(), jobLock.ttl)
 	if err != nil {
 		return
 	}
@@ -67,13 +77,16 @@ func (jobLock *JobLock) TryLock() (err error) {
 	// 3 创建事务txr
 	txn := jobLock.kv.Txn(context.Background())
 
-	// 锁路径
-	lockKey := common.JOB_LOCK_DIR + jobLock.jobName
-
-	// 4 事务抢锁
-	txn.If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
-		Then(clientv3.OpPut(lockKey, "", clientv3.WithLease(leaseId))).
-		Else(clientv3.OpGet(lockKey))
+	// 4 事务抢锁，所有锁路径都未被占用才上锁
+	cmps := make([]clientv3.Cmp, 0, len(jobLock.lockKeys))
+	puts := make([]clientv3.Op, 0, len(jobLock.lockKeys))
+	for _, lockKey := range jobLock.lockKeys {
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0))
+		puts = append(puts, clientv3.OpPut(lockKey, jobLock.value, clientv3.WithLease(leaseId)))
+	}
+	txn.If(cmps...).
+		Then(puts...).
+		Else(clientv3.OpGet(jobLock.lockKeys[0]))
 
 	// 提交事务
 	txnResp, err := txn.Commit()
@@ -88,7 +101,13 @@ func (jobLock *JobLock) TryLock() (err error) {
 
 	// 5 成功返回 失败释放租约
 	if !txnResp.Succeeded {
-		err = common.ERR_LOCK_ALREADY_REQUIRED
+		err = common.ERR_NO_FREE_SLOT
+
+		// 第一把锁被占用，记录持有者
+		if rangeResp := txnResp.Responses[0].GetResponseRange(); rangeResp != nil && len(rangeResp.Kvs) != 0 {
+			err = common.ERR_LOCK_ALREADY_REQUIRED
+			jobLock.holder = common.DecodeJobLockValue(rangeResp.Kvs[0].Value)
+		}
 
 		// 取消自动续租
 		cancelFunc()
@@ -108,12 +127,18 @@ func (jobLock *JobLock) TryLock() (err error) {
 
 // 释放锁
 func (jobLock *JobLock) Unlock() {
+	if jobLock.claim != nil {
+		jobLock.claim.Unlock()
+	}
+
 	if jobLock.isLocked {
 		// 取消程序自动续租的协程
 		jobLock.cancelFunc()
 
-		// 释放租约
-		jobLock.lease.Revoke(context.Background(), jobLock.leaseId)
+		// 释放租约，保留的锁等租约过期
+		if !jobLock.keepLease {
+			jobLock.lease.Revoke(context.Background(), jobLock.leaseId)
+		}
 	}
 	return
 }
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+// 记录租约操作，事务总是成功
+type fakeLockLease struct {
+	clientv3.Lease
+	ttls    []int64
+	revoked []clientv3.LeaseID
+}
+
+func (lease *fakeLockLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	lease.ttls = append(lease.ttls, ttl)
+	return &clientv3.LeaseGrantResponse{ID: clientv3.LeaseID(len(lease.ttls)), TTL: ttl}, nil
+}
+
+func (lease *fakeLockLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	keepChan := make(chan *clientv3.LeaseKeepAliveResponse)
+	go func() {
+		<-ctx.Done()
+		close(keepChan)
+	}()
+	return keepChan, nil
+}
+
+func (lease *fakeLockLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	lease.revoked = append(lease.revoked, id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+type fakeLockKV struct {
+	clientv3.KV
+}
+
+func (kv *fakeLockKV) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeLockTxn{}
+}
+
+type fakeLockTxn struct{}
+
+func (txn *fakeLockTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { return txn }
+func (txn *fakeLockTxn) Then(ops ...clientv3.Op) clientv3.Txn { return txn }
+func (txn *fakeLockTxn) Else(ops ...clientv3.Op) clientv3.Txn { return txn }
+func (txn *fakeLockTxn) Commit() (*clientv3.TxnResponse, error) {
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+func TestFireClaimOutlivesUnlock(t *testing.T) {
+	lease := &fakeLockLease{}
+	jobMgr := &JobMgr{kv: &fakeLockKV{}, lease: lease}
+
+	claim := jobMgr.CreateFireClaim("job", "/cron/lock/job/fire/1000", "")
+	jobLock := jobMgr.CreateJobLock("job", []string{"/cron/lock/job"}, "")
+	if err := claim.TryLock(); err != nil {
+		t.Fatalf("claim TryLock() err: %v", err)
+	}
+	if err := jobLock.TryLock(); err != nil {
+		t.Fatalf("TryLock() err: %v", err)
+	}
+	jobLock.claim = claim
+
+	if lease.ttls[0] != common.JOB_FIRE_CLAIM_TTL || lease.ttls[1] != common.JOB_LOCK_TTL {
+		t.Fatalf("lease ttls = %v, want [%v %v]", lease.ttls, common.JOB_FIRE_CLAIM_TTL, common.JOB_LOCK_TTL)
+	}
+
+	// 释放时只撤销任务锁，认领等租约过期
+	jobLock.Unlock()
+	if len(lease.revoked) != 1 || lease.revoked[0] != jobLock.leaseId {
+		t.Fatalf("revoked leases = %v, want only the job lock lease %v", lease.revoked, jobLock.leaseId)
+	}
+}
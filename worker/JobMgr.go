@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"encoding/json"
 	"github.com/MrDragon1122/crontab/common"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
@@ -55,6 +56,24 @@ func InitJobMgr() (err error) {
 	log.Info("start killer job watch")
 	G_jobMgr.WatchKiller()
 
+	// 启动监听手动触发
+	log.Info("start trigger job watch")
+	if err = G_jobMgr.WatchTriggers(); err != nil {
+		return
+	}
+
+	// 启动监听master的下线请求
+	log.Info("start drain watch")
+	G_jobMgr.WatchDrain()
+
+	// leader分派模式下监听分派给本worker的执行
+	if G_dispatcher.IsLeaderMode() {
+		log.Info("start assignment watch")
+		if err = G_jobMgr.WatchAssignments(); err != nil {
+			return
+		}
+	}
+
 	return
 }
 
@@ -66,11 +85,23 @@ func (jobMgr *JobMgr) WatchJobs() (err error) {
 		return
 	}
 
+	// 加载任务的水位线，用于补执行worker离线期间错过的调度
+	watermarks, err := jobMgr.GetAllWatermarks()
+	if err != nil {
+		return
+	}
+
 	// 遍历输出所有的任务
 	for _, val := range getResponse.Kvs {
 		var job *common.Job
 		if job, err = common.Unpack(val.Value); err == nil {
+			// 暂停的任务、标签不匹配的任务不进入调度计划表
+			if job.Paused || !isSchedulable(job) {
+				continue
+			}
+
 			jobEvent := common.BuildJobEvent(common.JOB_EVENT_SAVE, job)
+			jobEvent.Watermark = getJobWatermark(job, watermarks)
 
 			// 把任务同步给调度协程scheduler
 			G_scheduler.PushJobEvent(jobEvent)
@@ -96,8 +127,12 @@ func (jobMgr *JobMgr) WatchJobs() (err error) {
 						log.Errorf("watch func unpackjob err: %v", job)
 						continue
 					}
-					// 构建一个更新Event
-					jobEvent = common.BuildJobEvent(common.JOB_EVENT_SAVE, job)
+					// 构建一个更新Event，暂停的任务、修改后标签不匹配的任务从调度计划表中移除
+					if job.Paused || !isSchedulable(job) {
+						jobEvent = common.BuildJobEvent(common.JOB_EVENT_DELETE, job)
+					} else {
+						jobEvent = common.BuildJobEvent(common.JOB_EVENT_SAVE, job)
+					}
 				case mvccpb.DELETE: // 任务删除
 					// get job name
 					jobName := common.ExtractJobName(string(watchEvent.Kv.Key))
@@ -131,7 +166,17 @@ func (jobMgr *JobMgr) WatchKiller() {
 				case mvccpb.PUT: // 杀死任务事件
 					jobName := common.ExtractKillerName(string(watchEvent.Kv.Key))
 					jobEvent = common.BuildJobEvent(common.JOB_EVENT_KILLER, &common.Job{Name: jobName})
+
+					// 指定了执行ID的只杀死该次执行
+					jobEvent.Killer = &common.JobKiller{}
+					if len(watchEvent.Kv.Value) != 0 {
+						if err := json.Unmarshal(watchEvent.Kv.Value, jobEvent.Killer); err != nil {
+							log.Errorf("watch func unpack killer err: %v", err)
+							continue
+						}
+					}
 				case mvccpb.DELETE: // killer租约过期，被自动删除
+					continue
 				}
 
 				// 推送给scheduler
@@ -141,10 +186,406 @@ func (jobMgr *JobMgr) WatchKiller() {
 	}()
 }
 
-// 创建任务执行锁
-func (jobMgr *JobMgr) CreateJobLock(jobName string) (jobLock *JobLock) {
+// 监听手动触发的任务
+func (jobMgr *JobMgr) WatchTriggers() (err error) {
+	// 先处理启动前已经写入、还没有被认领的触发请求
+	getResp, err := jobMgr.kv.Get(context.Background(), common.JOB_TRIGGER_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+	for _, kv := range getResp.Kvs {
+		jobMgr.pushTrigger(kv.Value)
+	}
+
+	go func() {
+		// 从get之后的版本监听,/cron/trigger/目录的后续变化
+		watchChan := jobMgr.watcher.Watch(context.Background(), common.JOB_TRIGGER_DIR, clientv3.WithRev(getResp.Header.Revision+1), clientv3.WithPrefix())
+
+		for watchResp := range watchChan {
+			for _, watchEvent := range watchResp.Events {
+				// 执行后删除或者过期删除，不需要处理
+				if watchEvent.Type != mvccpb.PUT {
+					continue
+				}
+				jobMgr.pushTrigger(watchEvent.Kv.Value)
+			}
+		}
+	}()
+
+	return
+}
+
+// 把手动触发请求推送给scheduler
+func (jobMgr *JobMgr) pushTrigger(value []byte) {
+	trigger, err := common.UnpackTrigger(value)
+	if err != nil || trigger.Job == nil {
+		log.Errorf("unpack trigger err: %v", err)
+		return
+	}
+
+	// 标签不匹配的worker不参与认领
+	if !trigger.Job.MatchLabels(G_config.Labels) {
+		return
+	}
+
+	jobEvent := common.BuildJobEvent(common.JOB_EVENT_TRIGGER, trigger.Job)
+	jobEvent.Trigger = trigger
+	G_scheduler.PushJobEvent(jobEvent)
+}
+
+// 任务是否进入本worker的调度计划表，leader分派模式下leader要调度所有任务，分派时再匹配标签
+func isSchedulable(job *common.Job) bool {
+	return G_dispatcher.IsLeaderMode() || job.MatchLabels(G_config.Labels)
+}
+
+// 监听leader分派给本worker的执行 /cron/assign/ip/
+func (jobMgr *JobMgr) WatchAssignments() (err error) {
+	assignDir := common.JOB_ASSIGN_DIR + G_register.localIp + "/"
+
+	// 先处理启动前已经分派的执行
+	getResp, err := jobMgr.kv.Get(context.Background(), assignDir, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+	for _, kv := range getResp.Kvs {
+		jobMgr.pushAssignment(kv.Value)
+	}
+
+	go func() {
+		watchChan := jobMgr.watcher.Watch(context.Background(), assignDir, clientv3.WithRev(getResp.Header.Revision+1), clientv3.WithPrefix())
+
+		for watchResp := range watchChan {
+			for _, watchEvent := range watchResp.Events {
+				// 接收后删除或者过期删除，不需要处理
+				if watchEvent.Type != mvccpb.PUT {
+					continue
+				}
+				jobMgr.pushAssignment(watchEvent.Kv.Value)
+			}
+		}
+	}()
+
+	return
+}
+
+// 把分派的执行推送给scheduler
+func (jobMgr *JobMgr) pushAssignment(value []byte) {
+	assignment, err := common.UnpackAssignment(value)
+	if err != nil || assignment.Job == nil {
+		log.Errorf("unpack assignment err: %v", err)
+		return
+	}
+
+	jobEvent := common.BuildJobEvent(common.JOB_EVENT_ASSIGN, assignment.Job)
+	jobEvent.Assignment = assignment
+	G_scheduler.PushJobEvent(jobEvent)
+}
+
+// 删除已经接收的分派记录，worker重启后不再重复执行
+func (jobMgr *JobMgr) DeleteAssignment(assignment *common.JobAssignment) {
+	if _, err := jobMgr.kv.Delete(context.Background(), common.BuildAssignKey(assignment)); err != nil {
+		log.Errorf("delete assignment %v of job %v err: %v", assignment.RunId, assignment.Job.Name, err)
+	}
+}
+
+// 本worker拒绝了分派的执行，删除分派记录并交还leader，leader跳过拒绝过的worker重新分派
+func (jobMgr *JobMgr) ReturnAssignment(assignment *common.JobAssignment) {
+	returned := *assignment
+	returned.Declined = append(append([]string{}, assignment.Declined...), G_register.localIp)
+
+	returnValue, err := json.Marshal(&returned)
+	if err != nil {
+		log.Errorf("pack returned assignment %v err: %v", assignment.RunId, err)
+		return
+	}
+
+	leaseResp, err := jobMgr.lease.Grant(context.Background(), common.JOB_ASSIGN_TTL)
+	if err != nil {
+		log.Errorf("return assignment %v of job %v err: %v", assignment.RunId, assignment.Job.Name, err)
+		return
+	}
+
+	// 分派记录已经过期或被删除时不再交还，避免重复分派
+	assignKey := common.BuildAssignKey(assignment)
+	txnResp, err := jobMgr.kv.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(assignKey), ">", 0)).
+		Then(
+			clientv3.OpDelete(assignKey),
+			clientv3.OpPut(common.BuildAssignReturnKey(assignment), string(returnValue), clientv3.WithLease(leaseResp.ID)),
+		).Commit()
+	if err != nil {
+		log.Errorf("return assignment %v of job %v err: %v", assignment.RunId, assignment.Job.Name, err)
+		return
+	}
+	if !txnResp.Succeeded {
+		jobMgr.lease.Revoke(context.Background(), leaseResp.ID)
+		log.Warnf("assignment %v of job %v is gone, run dropped", assignment.RunId, assignment.Job.Name)
+		return
+	}
+
+	log.Infof("return assignment %v of job %v to leader", assignment.RunId, assignment.Job.Name)
+}
+
+// 监听master发给本worker的下线请求 /cron/drain/ip
+func (jobMgr *JobMgr) WatchDrain() {
+	go func() {
+		watchChan := jobMgr.watcher.Watch(context.Background(), common.JOB_DRAIN_DIR+G_register.localIp)
+
+		for watchResp := range watchChan {
+			for _, watchEvent := range watchResp.Events {
+				if watchEvent.Type != mvccpb.PUT {
+					continue
+				}
+
+				drainRequest := &common.DrainRequest{}
+				if err := json.Unmarshal(watchEvent.Kv.Value, drainRequest); err != nil {
+					log.Errorf("unpack drain request err: %v", err)
+					continue
+				}
+
+				RequestDrain(time.Duration(drainRequest.Timeout) * time.Second)
+			}
+		}
+	}()
+}
+
+// 认领手动触发的请求，删除成功的worker负责执行，保证只执行一次
+// 删除请求的同时把状态更新为已认领，master据此区分认领和过期
+func (jobMgr *JobMgr) ClaimTrigger(trigger *common.JobTrigger) (err error) {
+	triggerKey := common.BuildTriggerKey(trigger)
+
+	statusOp, err := jobMgr.buildTriggerStatusOp(trigger, common.TRIGGER_STATUS_CLAIMED, nil)
+	if err != nil {
+		return
+	}
+
+	txnResp, err := jobMgr.kv.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(triggerKey), ">", 0)).
+		Then(clientv3.OpDelete(triggerKey), statusOp).
+		Commit()
+	if err != nil {
+		return
+	}
+
+	if !txnResp.Succeeded {
+		err = common.ERR_TRIGGER_ALREADY_CLAIMED
+	}
+	return
+}
+
+// 更新已认领的触发请求的状态
+func (jobMgr *JobMgr) UpdateTriggerStatus(trigger *common.JobTrigger, status string, cause error) {
+	statusOp, err := jobMgr.buildTriggerStatusOp(trigger, status, cause)
+	if err == nil {
+		_, err = jobMgr.kv.Txn(context.Background()).Then(statusOp).Commit()
+	}
+	if err != nil {
+		log.Errorf("update trigger %v status %v err: %v", trigger.TriggerId, status, err)
+	}
+}
+
+// 执行失败等待重试，退避期间集群中没有执行记录，写入重试时间，master不会把工作流节点当作卡住
+func (jobMgr *JobMgr) UpdateTriggerRetry(trigger *common.JobTrigger, retryTime time.Time) {
+	triggerStatus := buildTriggerStatus(trigger, common.TRIGGER_STATUS_RUNNING, nil)
+	triggerStatus.RetryTime = retryTime.UnixNano() / 1e6
+
+	statusOp, err := jobMgr.putTriggerStatusOp(triggerStatus)
+	if err == nil {
+		_, err = jobMgr.kv.Txn(context.Background()).Then(statusOp).Commit()
+	}
+	if err != nil {
+		log.Errorf("update trigger %v retry time err: %v", trigger.TriggerId, err)
+	}
+}
+
+func (jobMgr *JobMgr) buildTriggerStatusOp(trigger *common.JobTrigger, status string, cause error) (op clientv3.Op, err error) {
+	return jobMgr.putTriggerStatusOp(buildTriggerStatus(trigger, status, cause))
+}
+
+func buildTriggerStatus(trigger *common.JobTrigger, status string, cause error) (triggerStatus *common.JobTriggerStatus) {
+	triggerStatus = &common.JobTriggerStatus{
+		TriggerId:  trigger.TriggerId,
+		JobName:    trigger.Job.Name,
+		Status:     status,
+		Worker:     G_register.localIp,
+		UpdateTime: time.Now().UnixNano() / 1e6,
+	}
+	if cause != nil {
+		triggerStatus.Err = cause.Error()
+	}
+	return
+}
+
+func (jobMgr *JobMgr) putTriggerStatusOp(triggerStatus *common.JobTriggerStatus) (op clientv3.Op, err error) {
+	statusValue, err := json.Marshal(triggerStatus)
+	if err != nil {
+		return
+	}
+
+	leaseResp, err := jobMgr.lease.Grant(context.Background(), common.JOB_TRIGGER_STATUS_TTL)
+	if err != nil {
+		return
+	}
+
+	op = clientv3.OpPut(common.BuildTriggerStatusKey(triggerStatus.TriggerId), string(statusValue), clientv3.WithLease(leaseResp.ID))
+	return
+}
+
+// 创建任务执行锁，value记录持有锁的执行
+func (jobMgr *JobMgr) CreateJobLock(jobName string, lockKeys []string, value string) (jobLock *JobLock) {
 	// 返回一把锁
-	jobLock = InitJobLock(jobName, jobMgr.kv, jobMgr.lease)
+	jobLock = InitJobLock(jobName, lockKeys, value, jobMgr.kv, jobMgr.lease)
+
+	return
+}
+
+// 创建一次调度的认领锁，执行期间续租，结束后保留一段时间，晚到的worker不会重复执行
+func (jobMgr *JobMgr) CreateFireClaim(jobName string, fireKey string, value string) (jobLock *JobLock) {
+	jobLock = InitJobLock(jobName, []string{fireKey}, value, jobMgr.kv, jobMgr.lease)
+	jobLock.ttl = common.JOB_FIRE_CLAIM_TTL
+	jobLock.keepLease = true
+
+	return
+}
+
+// 杀死任务的某次执行，Replace策略使用
+func (jobMgr *JobMgr) KillJob(jobName string, runId string) (err error) {
+	killerValue, err := json.Marshal(&common.JobKiller{RunId: runId, Reason: common.JOB_KILL_REASON_REPLACE})
+	if err != nil {
+		return
+	}
+
+	// 与master强杀一致，利用租约设定killer的自动过期时间
+	leaseResp, err := jobMgr.lease.Grant(context.Background(), 1)
+	if err != nil {
+		return
+	}
+
+	_, err = jobMgr.kv.Put(context.Background(), common.JOB_KILLER_DIR+jobName, string(killerValue), clientv3.WithLease(leaseResp.ID))
+	return
+}
+
+// 回写强杀确认，master等待所有worker确认后返回
+func (jobMgr *JobMgr) AckKill(ack *common.KillAck) (err error) {
+	ackValue, err := json.Marshal(ack)
+	if err != nil {
+		return
+	}
+
+	leaseResp, err := jobMgr.lease.Grant(context.Background(), common.JOB_KILLACK_TTL)
+	if err != nil {
+		return
+	}
+
+	_, err = jobMgr.kv.Put(context.Background(), common.BuildKillAckKey(ack.KillId, ack.Worker, ack.RunId), string(ackValue), clientv3.WithLease(leaseResp.ID))
+	return
+}
+
+// 发布正在执行的任务，返回的函数在执行结束后撤销；worker宕机时租约过期自动删除
+func (jobMgr *JobMgr) PublishRunning(running *common.RunningJob) (unpublish func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	unpublish = cancel
+
+	runningValue, err := json.Marshal(running)
+	if err != nil {
+		return
+	}
+
+	leaseResp, err := jobMgr.lease.Grant(ctx, common.JOB_RUNNING_TTL)
+	if err != nil {
+		log.Errorf("publish running job %v err: %v", running.JobName, err)
+		return
+	}
+
+	// 执行期间自动续租
+	keepAliveChan, err := jobMgr.lease.KeepAlive(ctx, leaseResp.ID)
+	if err != nil {
+		log.Errorf("publish running job %v err: %v", running.JobName, err)
+		return
+	}
+	go func() {
+		for range keepAliveChan {
+		}
+	}()
+
+	// 撤销租约时key被删除
+	unpublish = func() {
+		cancel()
+		jobMgr.lease.Revoke(context.Background(), leaseResp.ID)
+	}
+
+	if _, err = jobMgr.kv.Put(ctx, common.BuildRunningKey(running.JobName, running.RunId), string(runningValue), clientv3.WithLease(leaseResp.ID)); err != nil {
+		log.Errorf("publish running job %v err: %v", running.JobName, err)
+	}
+	return
+}
+
+// 获取所有任务最近一次执行的计划时间
+func (jobMgr *JobMgr) GetAllWatermarks() (watermarks map[string]time.Time, err error) {
+	getResp, err := jobMgr.kv.Get(context.Background(), common.JOB_WATERMARK_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	watermarks = make(map[string]time.Time)
+	for _, val := range getResp.Kvs {
+		planTime, err := common.DecodeWatermark(val.Value)
+		if err != nil {
+			continue
+		}
+		watermarks[common.ExtractWatermarkName(string(val.Key))] = planTime
+	}
+
+	return
+}
+
+// 任务的水位线，分片任务取所有分片中最早的，有分片没有水位线时为空
+func getJobWatermark(job *common.Job, watermarks map[string]time.Time) (watermark time.Time) {
+	if job.Shards <= 1 {
+		return watermarks[job.Name]
+	}
+
+	for shard := 0; shard < job.Shards; shard++ {
+		shardWatermark, ok := watermarks[common.BuildShardName(job.Name, shard)]
+		if !ok {
+			return time.Time{}
+		}
+		if watermark.IsZero() || shardWatermark.Before(watermark) {
+			watermark = shardWatermark
+		}
+	}
+	return
+}
+
+// 获取任务最近一次成功执行的计划时间
+func (jobMgr *JobMgr) GetWatermark(jobName string) (planTime time.Time, err error) {
+	getResp, err := jobMgr.kv.Get(context.Background(), common.JOB_WATERMARK_DIR+jobName)
+	if err != nil || len(getResp.Kvs) == 0 {
+		return
+	}
+
+	return common.DecodeWatermark(getResp.Kvs[0].Value)
+}
+
+// 更新任务的水位线，只允许向后推进
+func (jobMgr *JobMgr) SaveWatermark(jobName string, planTime time.Time) (err error) {
+	key := common.JOB_WATERMARK_DIR + jobName
+	value := common.EncodeWatermark(planTime)
+
+	// 已有水位线，比它新才更新
+	txnResp, err := jobMgr.kv.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.Value(key), "<", value)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil || txnResp.Succeeded {
+		return
+	}
+
+	// 还没有水位线
+	_, err = jobMgr.kv.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
 
 	return
 }
@@ -4,14 +4,21 @@ import (
 	"context"
 	"github.com/MrDragon1122/crontab/common"
 	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/gridfs"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
 	"time"
+	"traefik/log"
 )
 
 // MongoDB存储日志
 type LogSink struct {
-	client        *mongo.Client
-	logCollection *mongo.Collection
-	logChan       chan *common.JobLog
+	client          *mongo.Client
+	logCollection   *mongo.Collection
+	chunkCollection *mongo.Collection // 实时输出分片
+	logChan         chan *common.JobLog
+	chunkChan       chan *common.JobLogChunk
+	flushChan       chan chan struct{} // 立即写入缓存的日志，完成后关闭应答
+	chunkFlushChan  chan chan struct{} // 立即写入缓存的输出分片
 }
 
 // 定义单例
@@ -28,12 +35,22 @@ func InitLogSink() (err error) {
 
 	// 选择db和collection
 	G_logsink = &LogSink{
-		client:        client,
-		logCollection: client.Database("cron").Collection("log"),
-		logChan:       make(chan *common.JobLog, 5000),
+		client:          client,
+		logCollection:   client.Database("cron").Collection("log"),
+		chunkCollection: client.Database("cron").Collection("log_chunk"),
+		logChan:         make(chan *common.JobLog, 5000),
+		chunkChan:       make(chan *common.JobLogChunk, 5000),
+		flushChan:       make(chan chan struct{}),
+		chunkFlushChan:  make(chan chan struct{}),
+	}
+
+	// 索引创建失败不影响写入
+	if err := G_logsink.createChunkIndexes(); err != nil {
+		log.Errorf("create log chunk indexes err: %v", err)
 	}
 
 	go G_logsink.writeLoop()
+	go G_logsink.chunkWriteLoop()
 
 	return
 }
@@ -67,13 +84,100 @@ func (logSink *LogSink) writeLoop() {
 			}
 
 			timer.Reset(1 * time.Second)
+		case done := <-logSink.flushChan:
+			// 取出队列中剩余的日志，和当前批次一起写入
+		FLUSH:
+			for {
+				select {
+				case log := <-logSink.logChan:
+					logBatch.Logs = append(logBatch.Logs, log)
+				default:
+					break FLUSH
+				}
+			}
+			if len(logBatch.Logs) != 0 {
+				logSink.SaveMongoDB(logBatch)
+				logBatch.Logs = logBatch.Logs[:0]
+			}
+			close(done)
+		}
+	}
+}
+
+// 输出分片存储协程，分片需要尽快可见，攒批时间更短
+func (logSink *LogSink) chunkWriteLoop() {
+	var chunkBatch = &common.LogBatch{}
+
+	timer := time.NewTimer(200 * time.Millisecond)
+	for {
+		select {
+		case chunk := <-logSink.chunkChan:
+			chunkBatch.Logs = append(chunkBatch.Logs, chunk)
+
+			if len(chunkBatch.Logs) >= 100 {
+				logSink.saveChunks(chunkBatch)
+				chunkBatch.Logs = chunkBatch.Logs[:0]
+				timer.Reset(200 * time.Millisecond)
+			}
+		case <-timer.C:
+			if len(chunkBatch.Logs) != 0 {
+				logSink.saveChunks(chunkBatch)
+				chunkBatch.Logs = chunkBatch.Logs[:0]
+			}
+
+			timer.Reset(200 * time.Millisecond)
+		case done := <-logSink.chunkFlushChan:
+		FLUSH:
+			for {
+				select {
+				case chunk := <-logSink.chunkChan:
+					chunkBatch.Logs = append(chunkBatch.Logs, chunk)
+				default:
+					break FLUSH
+				}
+			}
+			if len(chunkBatch.Logs) != 0 {
+				logSink.saveChunks(chunkBatch)
+				chunkBatch.Logs = chunkBatch.Logs[:0]
+			}
+			close(done)
 		}
 	}
 }
 
-// 批量写入日志
+// 批量写入日志，无序写入避免一条失败影响整批
 func (logSink *LogSink) SaveMongoDB(logBatch *common.LogBatch) {
-	logSink.logCollection.InsertMany(context.Background(), logBatch.Logs)
+	if _, err := logSink.logCollection.InsertMany(context.Background(), logBatch.Logs, options.InsertMany().SetOrdered(false)); err != nil {
+		log.Errorf("save %v job logs err: %v", len(logBatch.Logs), err)
+	}
+}
+
+// 批量写入输出分片，分片需要保持顺序
+func (logSink *LogSink) saveChunks(chunkBatch *common.LogBatch) {
+	if _, err := logSink.chunkCollection.InsertMany(context.Background(), chunkBatch.Logs); err != nil {
+		log.Errorf("save %v log chunks err: %v", len(chunkBatch.Logs), err)
+	}
+}
+
+// 立即写入缓存的日志和输出分片，worker退出前调用，超时返回false
+func (logSink *LogSink) Flush(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+
+	for _, flushChan := range []chan chan struct{}{logSink.chunkFlushChan, logSink.flushChan} {
+		done := make(chan struct{})
+		select {
+		case flushChan <- done:
+		case <-deadline:
+			return false
+		}
+
+		select {
+		case <-done:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
 }
 
 // 发送日志
@@ -84,3 +188,53 @@ func (logSink *LogSink) Append(joblog *common.JobLog) {
 		// 日志满了，就丢弃
 	}
 }
+
+// 发送输出分片，返回是否投递成功
+func (logSink *LogSink) AppendChunk(chunk *common.JobLogChunk) bool {
+	// 结束标记尽量不丢弃，否则实时输出不会结束，但最多等待一段时间
+	if chunk.Stream == common.LOG_STREAM_END {
+		return logSink.appendChunkWait(chunk, common.LOG_CHUNK_END_TIMEOUT)
+	}
+
+	select {
+	case logSink.chunkChan <- chunk:
+		return true
+	default:
+		// 分片满了，就丢弃
+		return false
+	}
+}
+
+// 等待写入队列空出位置，超时丢弃
+func (logSink *LogSink) appendChunkWait(chunk *common.JobLogChunk, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case logSink.chunkChan <- chunk:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// 打开保存完整输出的GridFS文件，文件名为执行ID
+func (logSink *LogSink) OpenOutputSpill(runId string) (stream *gridfs.UploadStream, err error) {
+	// bucket的读写缓冲不能在并发的上传之间共享，每次单独创建
+	bucket, err := gridfs.NewBucket(logSink.client.Database("cron"), options.GridFSBucket().SetName(common.JOB_OUTPUT_BUCKET))
+	if err != nil {
+		return
+	}
+	return bucket.OpenUploadStream(runId)
+}
+
+// 创建输出分片的索引：按执行ID和序号查询，过期自动删除
+func (logSink *LogSink) createChunkIndexes() (err error) {
+	ttl := int32(common.LOG_CHUNK_TTL / time.Second)
+
+	_, err = logSink.chunkCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: &common.LogChunkRunIndex{RunId: 1, Seq: 1}},
+		{Keys: &common.LogChunkTTLIndex{CreateTime: 1}, Options: options.Index().SetExpireAfterSeconds(ttl)},
+	})
+	return
+}
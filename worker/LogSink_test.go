@@ -0,0 +1,29 @@
+package worker
+
+import (
+	"github.com/MrDragon1122/crontab/common"
+	"testing"
+	"time"
+)
+
+func TestAppendChunkWaitTimeout(t *testing.T) {
+	logSink := &LogSink{chunkChan: make(chan *common.JobLogChunk, 1)}
+
+	if !logSink.appendChunkWait(&common.JobLogChunk{Stream: common.LOG_STREAM_END}, 10*time.Millisecond) {
+		t.Fatalf("appendChunkWait() = false with free queue")
+	}
+
+	// 写入队列满时不会一直阻塞
+	start := time.Now()
+	if logSink.appendChunkWait(&common.JobLogChunk{Stream: common.LOG_STREAM_END}, 10*time.Millisecond) {
+		t.Fatalf("appendChunkWait() = true with full queue")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("appendChunkWait() blocked %v", elapsed)
+	}
+
+	// 普通分片在队列满时直接丢弃
+	if logSink.AppendChunk(&common.JobLogChunk{Stream: common.LOG_STREAM_STDOUT}) {
+		t.Fatalf("AppendChunk() = true with full queue")
+	}
+}
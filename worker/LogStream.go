@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"bytes"
+	"github.com/MrDragon1122/crontab/common"
+	"sync"
+	"time"
+	"traefik/log"
+)
+
+// 输出分片的切分条件
+const (
+	logChunkFlushInterval = 500 * time.Millisecond // 最长攒批时间
+	logChunkMaxSize       = 64 * 1024              // 单个分片最大字节数
+)
+
+// 实时输出，把命令的stdout/stderr切分成分片，投递给LogSink
+type LogStream struct {
+	mutex   sync.Mutex
+	jobName string
+	runId   string
+	seq     int64                    // 已投递的分片序号
+	buffers map[string]*bytes.Buffer // 各输出流未投递的内容
+	limit   int64                    // 投递上限，0表示不限制
+	size    int64                    // 已写入的总字节数
+	closeCh chan struct{}
+	closed  bool
+}
+
+// 某个输出流的写入器
+type logStreamWriter struct {
+	logStream *LogStream
+	stream    string
+}
+
+// 创建实时输出，并启动定时投递
+func NewLogStream(jobName string, runId string, limit int64) (logStream *LogStream) {
+	logStream = &LogStream{
+		jobName: jobName,
+		runId:   runId,
+		limit:   limit,
+		buffers: map[string]*bytes.Buffer{
+			common.LOG_STREAM_STDOUT: &bytes.Buffer{},
+			common.LOG_STREAM_STDERR: &bytes.Buffer{},
+		},
+		closeCh: make(chan struct{}),
+	}
+
+	go logStream.flushLoop()
+
+	return
+}
+
+// 获取输出流的写入器
+func (logStream *LogStream) Writer(stream string) *logStreamWriter {
+	return &logStreamWriter{
+		logStream: logStream,
+		stream:    stream,
+	}
+}
+
+func (writer *logStreamWriter) Write(p []byte) (n int, err error) {
+	logStream := writer.logStream
+
+	logStream.mutex.Lock()
+	defer logStream.mutex.Unlock()
+
+	if logStream.closed {
+		return len(p), nil
+	}
+
+	n = len(p)
+	buf := logStream.buffers[writer.stream]
+
+	// 超过上限的输出不再投递，完整输出由OutputSpill保存
+	if logStream.limit > 0 {
+		remain := logStream.limit - logStream.size
+		if remain <= 0 {
+			return
+		}
+		if int64(len(p)) > remain {
+			p = p[:remain]
+			buf.Write(p)
+			buf.WriteString("\n...[output truncated]...\n")
+			logStream.size += int64(len(p))
+			logStream.flushStream(writer.stream)
+			return
+		}
+	}
+
+	buf.Write(p)
+	logStream.size += int64(len(p))
+
+	// 达到分片大小，立即投递
+	if buf.Len() >= logChunkMaxSize {
+		logStream.flushStream(writer.stream)
+	}
+
+	return
+}
+
+// 定时投递协程
+func (logStream *LogStream) flushLoop() {
+	ticker := time.NewTicker(logChunkFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			logStream.mutex.Lock()
+			logStream.flushStream(common.LOG_STREAM_STDOUT)
+			logStream.flushStream(common.LOG_STREAM_STDERR)
+			logStream.mutex.Unlock()
+		case <-logStream.closeCh:
+			return
+		}
+	}
+}
+
+// 投递某个输出流的内容，调用方持有锁
+func (logStream *LogStream) flushStream(stream string) {
+	buf := logStream.buffers[stream]
+	if buf.Len() == 0 {
+		return
+	}
+
+	logStream.appendChunk(stream, buf.String())
+	buf.Reset()
+}
+
+func (logStream *LogStream) appendChunk(stream string, data string) bool {
+	now := time.Now()
+	logStream.seq++
+	return G_logsink.AppendChunk(&common.JobLogChunk{
+		JobName:    logStream.jobName,
+		RunId:      logStream.runId,
+		Seq:        logStream.seq,
+		Stream:     stream,
+		Data:       data,
+		Time:       now.UnixNano() / 1e6,
+		CreateTime: now,
+	})
+}
+
+// 命令结束，投递剩余内容和结束标记
+func (logStream *LogStream) Close() {
+	logStream.mutex.Lock()
+	defer logStream.mutex.Unlock()
+
+	if logStream.closed {
+		return
+	}
+
+	logStream.flushStream(common.LOG_STREAM_STDOUT)
+	logStream.flushStream(common.LOG_STREAM_STDERR)
+	// 写入队列一直满时丢弃结束标记，不阻塞释放锁和上报结果
+	if !logStream.appendChunk(common.LOG_STREAM_END, "") {
+		log.Warnf("job %v run %v drop output end marker after %v", logStream.jobName, logStream.runId, common.LOG_CHUNK_END_TIMEOUT)
+	}
+
+	logStream.closed = true
+	close(logStream.closeCh)
+}
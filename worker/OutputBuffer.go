@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// 并发安全的输出缓冲，超过上限后保留头部和尾部各一半
+type OutputBuffer struct {
+	mutex   sync.Mutex
+	limit   int64        // 输出上限，0表示不限制
+	head    bytes.Buffer // 头部
+	tail    []byte       // 尾部环形缓冲
+	tailPos int          // 环形缓冲下一个写入位置
+	tailLen int          // 环形缓冲已写入长度
+	size    int64        // 实际写入的总字节数
+}
+
+func NewOutputBuffer(limit int64) *OutputBuffer {
+	return &OutputBuffer{limit: limit}
+}
+
+func (buffer *OutputBuffer) Write(p []byte) (n int, err error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	n = len(p)
+	buffer.size += int64(n)
+
+	if buffer.limit <= 0 {
+		buffer.head.Write(p)
+		return
+	}
+
+	// 先写满头部
+	headLimit := buffer.limit / 2
+	if remain := headLimit - int64(buffer.head.Len()); remain > 0 {
+		if int64(len(p)) <= remain {
+			buffer.head.Write(p)
+			return
+		}
+		buffer.head.Write(p[:remain])
+		p = p[remain:]
+	}
+
+	// 剩余的写入尾部环形缓冲
+	buffer.writeTail(p)
+	return
+}
+
+func (buffer *OutputBuffer) writeTail(p []byte) {
+	if buffer.tail == nil {
+		buffer.tail = make([]byte, buffer.limit-buffer.limit/2)
+	}
+	tailCap := len(buffer.tail)
+	if tailCap == 0 {
+		return
+	}
+
+	// 只有最后tailCap个字节有意义
+	if len(p) >= tailCap {
+		copy(buffer.tail, p[len(p)-tailCap:])
+		buffer.tailPos = 0
+		buffer.tailLen = tailCap
+		return
+	}
+
+	copied := copy(buffer.tail[buffer.tailPos:], p)
+	copy(buffer.tail, p[copied:])
+	buffer.tailPos = (buffer.tailPos + len(p)) % tailCap
+	if buffer.tailLen += len(p); buffer.tailLen > tailCap {
+		buffer.tailLen = tailCap
+	}
+}
+
+// 输出内容，被截断时在头尾之间插入截断说明
+func (buffer *OutputBuffer) Bytes() []byte {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if buffer.tailLen == 0 {
+		return buffer.head.Bytes()
+	}
+
+	var out bytes.Buffer
+	out.Write(buffer.head.Bytes())
+
+	omitted := buffer.size - int64(buffer.head.Len()) - int64(buffer.tailLen)
+	if omitted > 0 {
+		fmt.Fprintf(&out, "\n...[truncated %d bytes]...\n", omitted)
+	}
+
+	// 环形缓冲写满后，从写入位置开始才是最早的内容
+	if buffer.tailLen < len(buffer.tail) {
+		out.Write(buffer.tail[:buffer.tailLen])
+	} else {
+		out.Write(buffer.tail[buffer.tailPos:])
+		out.Write(buffer.tail[:buffer.tailPos])
+	}
+
+	return out.Bytes()
+}
+
+// 实际写入的总字节数
+func (buffer *OutputBuffer) Size() int64 {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.size
+}
+
+// 是否超过上限被截断
+func (buffer *OutputBuffer) IsTruncated() bool {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.limit > 0 && buffer.size > buffer.limit
+}
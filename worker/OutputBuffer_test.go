@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputBufferNotTruncated(t *testing.T) {
+	buffer := NewOutputBuffer(16)
+	buffer.Write([]byte("hello "))
+	buffer.Write([]byte("world"))
+
+	if got := string(buffer.Bytes()); got != "hello world" {
+		t.Errorf("Bytes() = %q, want %q", got, "hello world")
+	}
+	if buffer.IsTruncated() || buffer.Size() != 11 {
+		t.Errorf("IsTruncated() = %v, Size() = %v, want false, 11", buffer.IsTruncated(), buffer.Size())
+	}
+}
+
+func TestOutputBufferHeadTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"单次写入超过上限", []string{"0123456789abcdefghij"}, "01234\n...[truncated 10 bytes]...\nfghij"},
+		{"逐字节写入", strings.Split("0123456789abcdefghij", ""), "01234\n...[truncated 10 bytes]...\nfghij"},
+		{"尾部环形缓冲回绕", []string{"012345678", "9abc", "defghij"}, "01234\n...[truncated 10 bytes]...\nfghij"},
+		{"尾部未写满", []string{"0123456"}, "0123456"},
+	}
+
+	for _, test := range tests {
+		buffer := NewOutputBuffer(10)
+		for _, p := range test.writes {
+			buffer.Write([]byte(p))
+		}
+
+		if got := string(buffer.Bytes()); got != test.want {
+			t.Errorf("%v: Bytes() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOutputBufferIsTruncated(t *testing.T) {
+	buffer := NewOutputBuffer(10)
+	buffer.Write([]byte("0123456789"))
+	if buffer.IsTruncated() {
+		t.Errorf("IsTruncated() = true at exactly the limit")
+	}
+
+	buffer.Write([]byte("a"))
+	if !buffer.IsTruncated() || buffer.Size() != 11 {
+		t.Errorf("IsTruncated() = %v, Size() = %v, want true, 11", buffer.IsTruncated(), buffer.Size())
+	}
+}
+
+func TestOutputBufferUnlimited(t *testing.T) {
+	buffer := NewOutputBuffer(0)
+	data := strings.Repeat("x", 1<<16)
+	buffer.Write([]byte(data))
+
+	if string(buffer.Bytes()) != data || buffer.IsTruncated() {
+		t.Errorf("unlimited buffer truncated output")
+	}
+}
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"bytes"
+	"github.com/mongodb/mongo-go-driver/mongo/gridfs"
+	"sync"
+	"traefik/log"
+)
+
+// 完整输出的溢出存储，超过上限后把全部输出写入GridFS，没有超过上限时不写入
+type OutputSpill struct {
+	mutex   sync.Mutex
+	runId   string
+	limit   int64                // 超过该大小才开始保存
+	pending bytes.Buffer         // 超过上限前缓存在内存中的输出
+	stream  *gridfs.UploadStream // 已经开始保存时的上传流
+	err     error                // 保存失败后不再写入
+}
+
+func NewOutputSpill(runId string, limit int64) *OutputSpill {
+	return &OutputSpill{runId: runId, limit: limit}
+}
+
+// 保存失败不影响命令执行，总是返回写入成功
+func (spill *OutputSpill) Write(p []byte) (n int, err error) {
+	spill.mutex.Lock()
+	defer spill.mutex.Unlock()
+
+	n = len(p)
+	if spill.err != nil {
+		return
+	}
+
+	if spill.stream != nil {
+		spill.write(p)
+		return
+	}
+
+	// 超过上限后打开上传流，先写入缓存的内容
+	spill.pending.Write(p)
+	if int64(spill.pending.Len()) <= spill.limit {
+		return
+	}
+	if spill.stream, spill.err = G_logsink.OpenOutputSpill(spill.runId); spill.err != nil {
+		log.Errorf("open output spill %v err: %v", spill.runId, spill.err)
+		spill.pending.Reset()
+		return
+	}
+	spill.write(spill.pending.Bytes())
+	spill.pending.Reset()
+	return
+}
+
+func (spill *OutputSpill) write(p []byte) {
+	if _, spill.err = spill.stream.Write(p); spill.err != nil {
+		log.Errorf("write output spill %v err: %v", spill.runId, spill.err)
+		spill.stream.Abort()
+	}
+}
+
+// 命令结束，完成上传，返回完整输出是否保存成功
+func (spill *OutputSpill) Close() bool {
+	spill.mutex.Lock()
+	defer spill.mutex.Unlock()
+
+	spill.pending.Reset()
+	if spill.stream == nil || spill.err != nil {
+		return false
+	}
+
+	if spill.err = spill.stream.Close(); spill.err != nil {
+		log.Errorf("close output spill %v err: %v", spill.runId, spill.err)
+		return false
+	}
+	return true
+}
@@ -1,12 +1,19 @@
 package worker
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/MrDragon1122/crontab/common"
 	"github.com/coreos/etcd/clientv3"
 	"golang.org/x/net/context"
+	"io/ioutil"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
+	"traefik/log"
 )
 
 // 注册节点到etcd /cron/workers/ip
@@ -15,11 +22,19 @@ type Register struct {
 	kv     clientv3.KV
 	lease  clientv3.Lease
 
-	localIp string //本机Ip
+	localIp   string    //本机Ip
+	hostname  string    // 主机名
+	startTime time.Time // worker启动时间
+
+	stopChan    chan struct{} // 关闭时注销节点
+	stoppedChan chan struct{} // 注销完成后关闭
 }
 
 var (
 	G_register *Register
+
+	// worker的构建版本，编译时通过 -ldflags "-X github.com/MrDragon1122/crontab/worker.BuildVersion=v1.0.0" 注入
+	BuildVersion = "dev"
 )
 
 // 获取本机ip
@@ -63,9 +78,13 @@ func InitRegister() (err error) {
 	lease := clientv3.NewLease(client)
 
 	G_register = &Register{
-		client: client,
-		kv:     kv,
-		lease:  lease,
+		client:    client,
+		kv:        kv,
+		lease:     lease,
+		startTime: time.Now(),
+
+		stopChan:    make(chan struct{}),
+		stoppedChan: make(chan struct{}),
 	}
 
 	// 获取本地ip
@@ -73,20 +92,47 @@ func InitRegister() (err error) {
 		return
 	}
 
+	// 获取主机名
+	if G_register.hostname, err = os.Hostname(); err != nil {
+		return
+	}
+
 	// 启动服务注册
 	go G_register.keepOnline()
 
 	return
 }
 
-// 注册到etcd /cron/workers/ip
-func (register *Register) keepOnline() (err error) {
+// 注销节点，删除/cron/workers/ip，master和leader不再把它当作在线worker
+// 续租协程卡在etcd请求上时最多等待timeout，返回是否注销完成，超时后由租约过期删除
+func (register *Register) Deregister(timeout time.Duration) bool {
+	close(register.stopChan)
+
+	select {
+	case <-register.stoppedChan:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// 注册到etcd /cron/workers/ip，值为worker的节点信息
+func (register *Register) keepOnline() {
+	defer close(register.stoppedChan)
+
 	// 注册路径
 	rekey := common.JOB_WORKER_DIR + register.localIp
 
 	for {
+		// 已经注销，不再注册
+		select {
+		case <-register.stopChan:
+			return
+		default:
+		}
+
 		// 注册租约
-		grantResp, err := register.lease.Grant(context.Background(), 10)
+		grantResp, err := register.lease.Grant(context.Background(), common.WORKER_REGISTER_TTL)
 		if err != nil {
 			// 自动重试
 			time.Sleep(1 * time.Second)
@@ -97,33 +143,89 @@ func (register *Register) keepOnline() (err error) {
 		leaseID := grantResp.ID
 
 		// 自动续租
-		keepAliveChan, err := register.lease.KeepAlive(context.Background(), leaseID)
+		ctx, cancel := context.WithCancel(context.Background())
+		keepAliveChan, err := register.lease.KeepAlive(ctx, leaseID)
 		if err != nil {
 			time.Sleep(1 * time.Second)
+			cancel()
 			continue
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		_, err = register.kv.Put(ctx, rekey, "", clientv3.WithLease(leaseID))
-		if err != nil {
+		if err = register.report(ctx, rekey, leaseID); err != nil {
 			time.Sleep(1 * time.Second)
 			cancel()
 			continue
 		}
 
-		// 处理续租应答
+		// 处理续租应答，定时刷新节点信息
+		reportTicker := time.NewTicker(common.WORKER_REPORT_INTERVAL)
+	KEEPALIVE:
 		for {
 			select {
-			// 自动续租应答
 			case keepResp := <-keepAliveChan:
+				// 续租失败，重新注册
 				if keepResp == nil {
-					break
+					break KEEPALIVE
+				}
+			case <-reportTicker.C:
+				if err := register.report(ctx, rekey, leaseID); err != nil {
+					log.Errorf("report worker info err: %v", err)
 				}
+			case <-register.stopChan:
+				// 撤销租约，注册信息立即删除
+				reportTicker.Stop()
+				cancel()
+				revokeCtx, revokeCancel := context.WithTimeout(context.Background(), common.WORKER_DEREGISTER_TIMEOUT)
+				if _, err := register.lease.Revoke(revokeCtx, leaseID); err != nil {
+					log.Errorf("deregister worker err: %v", err)
+				}
+				revokeCancel()
+				return
 			}
 		}
+		reportTicker.Stop()
 
 		time.Sleep(1 * time.Second)
 		cancel()
 	}
+}
+
+// 上报节点信息
+func (register *Register) report(ctx context.Context, rekey string, leaseID clientv3.LeaseID) (err error) {
+	usedSlots, maxSlots := G_executor.SlotUsage()
+	workerInfo := &common.WorkerInfo{
+		Ip:         register.localIp,
+		Hostname:   register.hostname,
+		Version:    BuildVersion,
+		StartTime:  register.startTime.UnixNano() / 1e6,
+		CpuCount:   runtime.NumCPU(),
+		Labels:     G_config.Labels,
+		Running:    G_executor.RunningCount(),
+		UsedSlots:  usedSlots,
+		MaxSlots:   maxSlots,
+		Load:       getLoadAvg(),
+		UpdateTime: time.Now().UnixNano() / 1e6,
+	}
+
+	value, err := json.Marshal(workerInfo)
+	if err != nil {
+		return
+	}
+
+	_, err = register.kv.Put(ctx, rekey, string(value), clientv3.WithLease(leaseID))
+	return
+}
+
+// 读取系统负载，读取失败时为0
+func getLoadAvg() (load [3]float64) {
+	bytes, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return
+	}
+
+	fields := strings.Fields(string(bytes))
+	for i := 0; i < len(load) && i < len(fields); i++ {
+		load[i], _ = strconv.ParseFloat(fields[i], 64)
+	}
 	return
 }
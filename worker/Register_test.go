@@ -0,0 +1,23 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeregisterTimeout(t *testing.T) {
+	// 续租协程卡住时不会一直等待
+	register := &Register{stopChan: make(chan struct{}), stoppedChan: make(chan struct{})}
+	if register.Deregister(10 * time.Millisecond) {
+		t.Fatalf("Deregister() = true while keepOnline is stuck")
+	}
+
+	register = &Register{stopChan: make(chan struct{}), stoppedChan: make(chan struct{})}
+	go func() {
+		<-register.stopChan
+		close(register.stoppedChan)
+	}()
+	if !register.Deregister(time.Second) {
+		t.Fatalf("Deregister() = false after keepOnline stopped")
+	}
+}
@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/pkg/errors"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// 按任务配置的runAsUser/runAsGroup解析子进程的身份，为空则与worker相同
+func resolveRunAs(job *common.Job) (credential *syscall.Credential, runAsUser *user.User, err error) {
+	if job.RunAsUser == "" {
+		if job.RunAsGroup != "" {
+			err = common.ERR_INVALID_RUN_AS
+		}
+		return
+	}
+
+	// 只能切换到worker配置允许的用户
+	if !isRunAsAllowed(job.RunAsUser) {
+		err = errors.Wrapf(common.ERR_RUN_AS_NOT_ALLOWED, "run as %v", job.RunAsUser)
+		return
+	}
+
+	// 支持用户名或者uid
+	if runAsUser, err = lookupUser(job.RunAsUser); err != nil {
+		err = errors.Wrapf(err, "run as %v", job.RunAsUser)
+		return
+	}
+
+	groupIds, err := runAsUser.GroupIds()
+	if err != nil {
+		return
+	}
+
+	// 默认使用用户的主组，指定的组必须是用户所属的组
+	gid := runAsUser.Gid
+	if job.RunAsGroup != "" {
+		var group *user.Group
+		if group, err = lookupGroup(job.RunAsGroup); err != nil {
+			err = errors.Wrapf(err, "run as group %v", job.RunAsGroup)
+			return
+		}
+		if group.Gid != runAsUser.Gid && !containsString(groupIds, group.Gid) {
+			err = errors.Wrapf(common.ERR_RUN_AS_NOT_ALLOWED, "run as group %v", job.RunAsGroup)
+			return
+		}
+		gid = group.Gid
+	}
+
+	credential = &syscall.Credential{}
+	if credential.Uid, err = parseId(runAsUser.Uid); err != nil {
+		return
+	}
+	if credential.Gid, err = parseId(gid); err != nil {
+		return
+	}
+
+	// 附加组与用户登录时一致
+	for _, groupId := range groupIds {
+		var id uint32
+		if id, err = parseId(groupId); err != nil {
+			return
+		}
+		credential.Groups = append(credential.Groups, id)
+	}
+
+	return
+}
+
+// 用户是否在worker的允许列表中，*表示允许所有用户
+func isRunAsAllowed(name string) bool {
+	return containsString(G_config.AllowedRunAsUsers, "*") || containsString(G_config.AllowedRunAsUsers, name)
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if runAsUser, err := user.Lookup(name); err == nil {
+		return runAsUser, nil
+	}
+	return user.LookupId(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if group, err := user.LookupGroup(name); err == nil {
+		return group, nil
+	}
+	return user.LookupGroupId(name)
+}
+
+func parseId(id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 10, 32)
+	return uint32(value), err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,16 +1,21 @@
 package worker
 
 import (
+	"container/heap"
+	"fmt"
 	"github.com/MrDragon1122/crontab/common"
 	"time"
 	"traefik/log"
 )
 
 type Scheduler struct {
-	jobEventChan     chan *common.JobEvent               // etcd中任务事件队列
-	jobPlanTable     map[string]*common.JobSchedulerPlan // 任务调度计划表 key:value = jobName:jobschedulerPlan
-	jobExecuingTable map[string]*common.JobExecuteInfo   // 任务执行表
-	jobResultChan    chan *common.JobExecuteResult
+	jobEventChan      chan *common.JobEvent               // etcd中任务事件队列
+	jobPlanTable      map[string]*common.JobSchedulerPlan // 任务调度计划表 key:value = jobName:jobschedulerPlan
+	workflowPlanTable map[string]*common.JobSchedulerPlan // 工作流调度计划表 key:value = workflowName:jobschedulerPlan
+	jobPlanHeap       jobPlanHeap                         // 按下次调度时间排序的任务计划，包括工作流
+	jobExecuingTable  map[string]*common.JobExecuteInfo   // 任务执行表 key:value = runId:jobExecuteInfo
+	jobResultChan     chan *common.JobExecuteResult
+	countChan         chan chan int // 查询执行表中的执行数，worker下线时使用
 }
 
 // 定义单例
@@ -21,10 +26,12 @@ var (
 // 初始化调度器
 func InitScheduler() {
 	G_scheduler = &Scheduler{
-		jobEventChan:     make(chan *common.JobEvent, 1000),
-		jobPlanTable:     make(map[string]*common.JobSchedulerPlan),
-		jobExecuingTable: make(map[string]*common.JobExecuteInfo),
-		jobResultChan:    make(chan *common.JobExecuteResult, 1000),
+		jobEventChan:      make(chan *common.JobEvent, 1000),
+		jobPlanTable:      make(map[string]*common.JobSchedulerPlan),
+		workflowPlanTable: make(map[string]*common.JobSchedulerPlan),
+		jobExecuingTable:  make(map[string]*common.JobExecuteInfo),
+		jobResultChan:     make(chan *common.JobExecuteResult, 1000),
+		countChan:         make(chan chan int),
 	}
 
 	// 启动调度协程
@@ -47,51 +54,295 @@ func (scheduler *Scheduler) handleJobEvent(jobEvent *common.JobEvent) {
 			return // 直接忽略任务
 		}
 
-		scheduler.jobPlanTable[jobEvent.Job.Name] = jobSchedulerPlan
-	case common.JOB_EVENT_DELETE:
-		if _, ok := scheduler.jobPlanTable[jobEvent.Job.Name]; ok {
-			delete(scheduler.jobPlanTable, jobEvent.Job.Name)
+		// worker启动时加载的任务，从最近一次执行之后开始调度，错过的调度交给TrySchedule按策略处理
+		if _, ok := scheduler.jobPlanTable[jobEvent.Job.Name]; !ok && !jobEvent.Watermark.IsZero() {
+			if nextTime := jobSchedulerPlan.Next(jobEvent.Watermark); !nextTime.IsZero() && nextTime.Before(jobSchedulerPlan.NextTime) {
+				jobSchedulerPlan.NextTime = nextTime
+			}
 		}
+
+		scheduler.putJobPlan(scheduler.jobPlanTable, jobSchedulerPlan)
+	case common.JOB_EVENT_DELETE:
+		scheduler.removeJobPlan(scheduler.jobPlanTable, jobEvent.Job.Name)
 	case common.JOB_EVENT_KILLER:
 		// 取消掉command的执行，判定任务是否在执行中
-		if jobExecuteInfo, ok := scheduler.jobExecuingTable[jobEvent.Job.Name]; ok {
-			jobExecuteInfo.CancelFunc() // 取消子进程的运行，任务退出
-			log.Infof("kill job: %v success", jobEvent.Job.Name)
-		} else {
+		killing := make([]string, 0)
+		for _, jobExecuteInfo := range scheduler.jobExecuingTable {
+			if jobExecuteInfo.Job.Name != jobEvent.Job.Name {
+				continue
+			}
+			if jobEvent.Killer.RunId != "" && jobEvent.Killer.RunId != jobExecuteInfo.RunId {
+				continue
+			}
+			// 通知执行协程结束整个进程组，确认退出后回传结果并回写确认，不阻塞调度协程
+			jobExecuteInfo.Kill(jobEvent.Killer)
+			killing = append(killing, jobExecuteInfo.RunId)
+			log.Infof("kill job: %v run: %v requested", jobEvent.Job.Name, jobExecuteInfo.RunId)
+		}
+		if len(killing) == 0 {
 			log.Infof("job %v not executing", jobEvent.Job.Name)
 		}
+
+		// 确认收到请求，master等待列出的执行各自确认退出
+		if jobEvent.Killer.KillId != "" {
+			ack := &common.KillAck{
+				KillId:  jobEvent.Killer.KillId,
+				JobName: jobEvent.Job.Name,
+				Worker:  G_register.localIp,
+				Running: len(killing) != 0,
+				Killing: killing,
+			}
+			go G_jobMgr.AckKill(ack)
+		}
+	case common.JOB_EVENT_TRIGGER:
+		// 手动触发不受调度计划影响，暂停的任务也可以执行
+		jobExecuteInfo := common.BuildTriggerExecuteInfo(jobEvent.Trigger)
+
+		log.Infof("do triggered job：%v, trigger: %v", jobExecuteInfo.Job.Name, jobEvent.Trigger.TriggerId)
+		scheduler.startExecution(jobExecuteInfo)
+	case common.JOB_EVENT_ASSIGN:
+		assignment := jobEvent.Assignment
+
+		// Queue策略同样限制本worker上的排队数
+		if assignment.Job.ConcurrencyPolicy == common.CONCURRENCY_POLICY_QUEUE &&
+			scheduler.countExecuting(assignment.Job.Name) >= common.QUEUE_MAX_LOCAL_EXECUTIONS*getShardTotal(assignment.Job) {
+			log.Infof("%v already queued，skip assigned run %v", assignment.Job.Name, assignment.RunId)
+			go G_jobMgr.DeleteAssignment(assignment)
+			return
+		}
+
+		jobExecuteInfo := common.BuildAssignExecuteInfo(assignment)
+
+		log.Infof("do assigned job：%v, run: %v, leader: %v", jobExecuteInfo.Job.Name, assignment.RunId, assignment.Leader)
+
+		// 开始执行后才删除分派记录，槽位用满或正在下线时交还leader重新分派
+		if err := scheduler.startExecution(jobExecuteInfo); err != nil {
+			go G_jobMgr.ReturnAssignment(assignment)
+			return
+		}
+		go G_jobMgr.DeleteAssignment(assignment)
+	case common.JOB_EVENT_KILL_ALL:
+		// worker下线等待超时，结束剩余的执行，释放锁并记录日志
+		for _, jobExecuteInfo := range scheduler.jobExecuingTable {
+			jobExecuteInfo.CancelFunc()
+			log.Infof("kill job: %v run: %v for worker drain", jobExecuteInfo.Job.Name, jobExecuteInfo.RunId)
+		}
+	case common.JOB_EVENT_WATERMARK:
+		scheduler.handleWatermark(jobEvent.Job.Name, jobEvent.WatermarkName, jobEvent.Watermark)
+	case common.JOB_EVENT_LEADER_ELECTED:
+		scheduler.catchUpFromWatermarks(jobEvent.Watermarks)
+	case common.JOB_EVENT_WORKFLOW_SAVE:
+		// 没有cron表达式的工作流只能手动启动
+		if jobEvent.Workflow.CronExpr == "" {
+			scheduler.removeJobPlan(scheduler.workflowPlanTable, jobEvent.Workflow.Name)
+			return
+		}
+
+		jobSchedulerPlan, err := common.BuildWorkflowSchedulerPlan(jobEvent.Workflow)
+		if err != nil {
+			return
+		}
+		scheduler.putJobPlan(scheduler.workflowPlanTable, jobSchedulerPlan)
+	case common.JOB_EVENT_WORKFLOW_DELETE:
+		scheduler.removeJobPlan(scheduler.workflowPlanTable, jobEvent.Workflow.Name)
+	}
+}
+
+// 保存任务计划，已存在则替换
+func (scheduler *Scheduler) putJobPlan(planTable map[string]*common.JobSchedulerPlan, jobPlan *common.JobSchedulerPlan) {
+	oldPlan := planTable[jobPlan.Job.Name]
+	planTable[jobPlan.Job.Name] = jobPlan
+
+	// 任务更新时保留等待补执行的调度
+	if oldPlan != nil {
+		jobPlan.Misfires = oldPlan.Misfires
+		jobPlan.MisfireWait = oldPlan.MisfireWait
+	}
+
+	// 没有下次调度时间的任务不进入调度堆
+	if jobPlan.NextTime.IsZero() {
+		if oldPlan != nil {
+			scheduler.jobPlanHeap.Remove(oldPlan)
+		}
+		return
+	}
+	scheduler.jobPlanHeap.Put(oldPlan, jobPlan)
+}
+
+// 删除任务计划
+func (scheduler *Scheduler) removeJobPlan(planTable map[string]*common.JobSchedulerPlan, name string) {
+	if jobPlan, ok := planTable[name]; ok {
+		scheduler.jobPlanHeap.Remove(jobPlan)
+		delete(planTable, name)
 	}
 }
 
 // 重新计算任务调度状态,实现任务的准确调度
+// 只检查堆顶到期的任务，每个到期任务的更新为O(log n)
 func (scheduler *Scheduler) TrySchedule() (schedulerAfter time.Duration) {
 	now := time.Now()
-	var nearTime *time.Time
 
-	// 如果任务表为空
-	if len(scheduler.jobPlanTable) == 0 {
-		schedulerAfter = 1 * time.Second
+	for {
+		jobPlan := scheduler.jobPlanHeap.Top()
+
+		// 如果任务表为空
+		if jobPlan == nil {
+			schedulerAfter = 1 * time.Second
+			return
+		}
+
+		// 最近一个任务还没到期
+		if jobPlan.NextTime.After(now) {
+			schedulerAfter = jobPlan.NextTime.Sub(now)
+			return
+		}
+
+		// 尝试执行任务，晚于计划时间太多的按misfire策略处理
+		if jobPlan.Workflow != nil {
+			scheduler.startWorkflow(jobPlan)
+		} else if now.Sub(jobPlan.NextTime) > time.Duration(G_config.MisfireThreshold)*time.Second {
+			scheduler.handleMisfire(jobPlan, now)
+		} else {
+			scheduler.TryStartJob(*jobPlan, false)
+
+			// leader等待的补执行可能已经超时
+			scheduler.tryStartMisfire(jobPlan)
+		}
+
+		// 更新下次执行时间，没有下次执行时间的任务移出调度堆
+		jobPlan.NextTime = jobPlan.Next(now)
+		if jobPlan.NextTime.IsZero() {
+			heap.Pop(&scheduler.jobPlanHeap)
+			continue
+		}
+		heap.Fix(&scheduler.jobPlanHeap, jobPlan.Index)
+	}
+}
+
+// 处理错过的调度，jobPlan.NextTime是第一个错过的计划时间
+func (scheduler *Scheduler) handleMisfire(jobPlan *common.JobSchedulerPlan, now time.Time) {
+	job := jobPlan.Job
+	missed := jobPlan.MisfireTimes(jobPlan.NextTime, now)
+
+	switch {
+	case len(missed) == 0:
+		log.Infof("job %v misfired at %v, skip", job.Name, jobPlan.NextTime)
+	case job.MisfirePolicy == common.MISFIRE_POLICY_RUN_ALL:
+		// 按计划时间先后逐个补执行，同一时刻只执行一个
+		log.Infof("job %v misfired since %v, run last %v times", job.Name, jobPlan.NextTime, len(missed))
+		jobPlan.Misfires = append(jobPlan.Misfires, missed...)
+		if overflow := len(jobPlan.Misfires) - job.GetMisfireMaxRuns(); overflow > 0 {
+			jobPlan.Misfires = jobPlan.Misfires[overflow:]
+		}
+		scheduler.tryStartMisfire(jobPlan)
+	default:
+		// 只补执行最近错过的一次
+		log.Infof("job %v misfired since %v, run once", job.Name, jobPlan.NextTime)
+		misfirePlan := *jobPlan
+		misfirePlan.NextTime = missed[len(missed)-1]
+		scheduler.TryStartJob(misfirePlan, true)
+	}
+}
+
+// 任务空闲时，补执行下一个错过的调度
+func (scheduler *Scheduler) tryStartMisfire(jobPlan *common.JobSchedulerPlan) {
+	if len(jobPlan.Misfires) == 0 {
+		return
+	}
+
+	// leader分派的执行不在本worker的执行表中，等水位线推进到上一个补执行
+	dispatched := G_dispatcher.IsLeaderMode() && !jobPlan.Job.IsBroadcast()
+	if dispatched {
+		if !G_dispatcher.IsLeader() {
+			// 补执行由leader负责，当选时从水位线重新计算
+			jobPlan.Misfires = nil
+			return
+		}
+		if jobPlan.MisfireWait != nil && time.Now().Before(jobPlan.MisfireWait.Deadline) {
+			return
+		}
+	} else if scheduler.countExecuting(jobPlan.Job.Name) != 0 {
+		return
+	}
+
+	misfirePlan := *jobPlan
+	misfirePlan.NextTime = jobPlan.Misfires[0]
+	jobPlan.Misfires = jobPlan.Misfires[1:]
+
+	if dispatched {
+		jobPlan.MisfireWait = buildMisfireWait(jobPlan.Job, misfirePlan.NextTime)
+	}
+	scheduler.TryStartJob(misfirePlan, true)
+}
+
+// 等待补执行的每个分片推进水位线
+func buildMisfireWait(job *common.Job, planTime time.Time) *common.MisfireWait {
+	misfireWait := &common.MisfireWait{
+		PlanTime: planTime,
+		Waiting:  make(map[string]bool),
+		Deadline: time.Now().Add(common.MISFIRE_DISPATCH_WAIT),
+	}
+
+	// 只有成功的执行推进水位线，失败或超时的补执行等到截止时间再分派下一个，截止时间不早于任务超时
+	if timeout := time.Duration(job.Timeout)*time.Second + job.GetKillGracePeriod(); job.Timeout > 0 && timeout > common.MISFIRE_DISPATCH_WAIT {
+		misfireWait.Deadline = time.Now().Add(timeout)
+	}
+
+	if job.Shards <= 1 {
+		misfireWait.Waiting[job.Name] = true
+		return misfireWait
+	}
+	for shard := 0; shard < job.Shards; shard++ {
+		misfireWait.Waiting[common.BuildShardName(job.Name, shard)] = true
+	}
+	return misfireWait
+}
+
+// 水位线推进，leader等待的补执行全部分片结束后分派下一个
+func (scheduler *Scheduler) handleWatermark(jobName string, watermarkName string, watermark time.Time) {
+	jobPlan, ok := scheduler.jobPlanTable[jobName]
+	if !ok || jobPlan.MisfireWait == nil || watermark.Before(jobPlan.MisfireWait.PlanTime) {
 		return
 	}
 
+	delete(jobPlan.MisfireWait.Waiting, watermarkName)
+	if len(jobPlan.MisfireWait.Waiting) != 0 {
+		return
+	}
+
+	jobPlan.MisfireWait = nil
+	scheduler.tryStartMisfire(jobPlan)
+}
+
+// 当选leader，选举期间没有leader分派，从水位线之后重新调度错过的计划时间
+func (scheduler *Scheduler) catchUpFromWatermarks(watermarks map[string]time.Time) {
 	for _, jobPlan := range scheduler.jobPlanTable {
-		if jobPlan.NextTime.Before(now) || jobPlan.NextTime.Equal(now) {
-			//TODO:尝试执行任务
-			scheduler.TryStartJob(*jobPlan)
+		// 之前的leader分派的补执行由水位线判断是否执行过
+		jobPlan.MisfireWait = nil
 
-			// 更新下次执行时间
-			jobPlan.NextTime = jobPlan.Expr.Next(now)
+		if jobPlan.Job.IsBroadcast() {
+			continue
 		}
 
-		// 统计最近一个要过期的任务时间
-		if nearTime == nil || nearTime.After(jobPlan.NextTime) {
-			nearTime = &jobPlan.NextTime
+		watermark := getJobWatermark(jobPlan.Job, watermarks)
+		if watermark.IsZero() {
+			continue
 		}
-	}
 
-	schedulerAfter = (*nearTime).Sub(now)
+		// 与worker启动时一致，晚于阈值的由TrySchedule按misfire策略处理
+		nextTime := jobPlan.Next(watermark)
+		if nextTime.IsZero() || (jobPlan.Index >= 0 && !nextTime.Before(jobPlan.NextTime)) {
+			continue
+		}
 
-	return
+		log.Infof("job %v catch up from watermark %v", jobPlan.Job.Name, watermark)
+		jobPlan.NextTime = nextTime
+		if jobPlan.Index >= 0 {
+			heap.Fix(&scheduler.jobPlanHeap, jobPlan.Index)
+		} else {
+			heap.Push(&scheduler.jobPlanHeap, jobPlan)
+		}
+	}
 }
 
 // 调度协程
@@ -111,6 +362,8 @@ func (scheduler *Scheduler) schedulerLoop() {
 		case <-schedulerTimer.C: // 最近的任务到期了
 		case jobResult := <-scheduler.jobResultChan:
 			scheduler.handleJobResult(jobResult)
+		case reply := <-scheduler.countChan:
+			reply <- len(scheduler.jobExecuingTable)
 		}
 
 		schedulerAfter = scheduler.TrySchedule()
@@ -118,25 +371,130 @@ func (scheduler *Scheduler) schedulerLoop() {
 	}
 }
 
-// 尝试执行任务
-func (scheduler *Scheduler) TryStartJob(jobPlan common.JobSchedulerPlan) {
+// 尝试执行任务，isMisfire表示错过调度后的补执行
+func (scheduler *Scheduler) TryStartJob(jobPlan common.JobSchedulerPlan, isMisfire bool) {
+	// 分片任务每次调度产生多个执行，每个分片一把锁，由抢到锁的worker执行
+	shardTotal := getShardTotal(jobPlan.Job)
+
+	// leader分派模式下，非广播任务只由leader分派，广播任务仍由每个标签匹配的worker执行
+	if G_dispatcher.IsLeaderMode() {
+		if !jobPlan.Job.IsBroadcast() {
+			scheduler.dispatchJob(&jobPlan, isMisfire, shardTotal)
+			return
+		}
+		if !jobPlan.Job.MatchLabels(G_config.Labels) {
+			return
+		}
+	}
+
 	// 调度和执行是2件事
-	// 执行的任务可能运行很久，1分钟调度60次，但是只能一次，防止并发
-	// 如果任务正在执行，则跳过本次调度
-	if _, ok := scheduler.jobExecuingTable[jobPlan.Job.Name]; ok {
-		log.Infof("%v not executed success，skip this execution", jobPlan.Job.Name)
+	// 执行的任务可能运行很久，是否允许并发由分布式锁按任务的并发策略在集群范围内控制
+	// Queue策略每个worker上同一任务(分片)最多一个执行、一个排队，其余调度跳过
+	if jobPlan.Job.ConcurrencyPolicy == common.CONCURRENCY_POLICY_QUEUE &&
+		scheduler.countExecuting(jobPlan.Job.Name) >= common.QUEUE_MAX_LOCAL_EXECUTIONS*shardTotal {
+		log.Infof("%v already queued，skip this execution", jobPlan.Job.Name)
+		return
+	}
+
+	for shard := 0; shard < shardTotal; shard++ {
+		// 构建执行状态信息
+		jobExecuteInfo := common.BuildJobExecuteInfo(&jobPlan)
+		jobExecuteInfo.IsMisfire = isMisfire
+		if jobPlan.Job.Shards > 1 {
+			jobExecuteInfo.ShardIndex = shard
+			jobExecuteInfo.ShardTotal = jobPlan.Job.Shards
+		}
+
+		// 执行任务
+		log.Infof("do job：%v, shard: %v/%v", jobExecuteInfo.Job.Name, shard, shardTotal)
+		scheduler.startExecution(jobExecuteInfo)
+	}
+}
+
+// 交给执行器执行并保存执行状态信息，本worker槽位用满放弃执行时不保存
+// 执行结果由调度协程处理，执行器先返回再保存执行状态不会错过结果
+func (scheduler *Scheduler) startExecution(jobExecuteInfo *common.JobExecuteInfo) (err error) {
+	if err = G_executor.ExecuteJob(jobExecuteInfo); err != nil {
+		log.Infof("job %v run %v declined: %v", jobExecuteInfo.Job.Name, jobExecuteInfo.RunId, err)
+		return
+	}
+
+	scheduler.jobExecuingTable[jobExecuteInfo.RunId] = jobExecuteInfo
+	return
+}
+
+// leader为每个分片生成一次执行，交给分派协程选择worker
+func (scheduler *Scheduler) dispatchJob(jobPlan *common.JobSchedulerPlan, isMisfire bool, shardTotal int) {
+	if !G_dispatcher.IsLeader() {
+		return
+	}
+
+	for shard := 0; shard < shardTotal; shard++ {
+		assignment := &common.JobAssignment{
+			RunId:     common.BuildRunId(),
+			Job:       jobPlan.Job,
+			Leader:    G_register.localIp,
+			PlanTime:  jobPlan.NextTime.UnixNano() / 1e6,
+			IsMisfire: isMisfire,
+		}
+		if jobPlan.Job.Shards > 1 {
+			assignment.ShardIndex = shard
+			assignment.ShardTotal = jobPlan.Job.Shards
+		}
+
+		G_dispatcher.Dispatch(assignment)
+	}
+}
+
+// 每次调度的执行数，不分片为1
+func getShardTotal(job *common.Job) int {
+	if job.Shards <= 1 {
+		return 1
+	}
+	return job.Shards
+}
+
+// 启动工作流，所有worker按计划时间生成同一个运行ID，只有一个启动成功
+// leader分派模式下只由leader启动
+func (scheduler *Scheduler) startWorkflow(jobPlan *common.JobSchedulerPlan) {
+	if G_dispatcher.IsLeaderMode() && !G_dispatcher.IsLeader() {
 		return
 	}
 
-	// 构建执行状态信息
-	jobExecuteInfo := common.BuildJobExecuteInfo(&jobPlan)
+	workflow := jobPlan.Workflow
+	runId := fmt.Sprintf("%d", jobPlan.NextTime.UnixNano()/1e6)
 
-	// 保存执行状态信息
-	scheduler.jobExecuingTable[jobPlan.Job.Name] = jobExecuteInfo
+	go func() {
+		if err := G_workflowMgr.StartWorkflowRun(workflow, runId); err != nil && err != common.ERR_WORKFLOW_RUN_EXISTS {
+			log.Errorf("start workflow %v run %v err: %v", workflow.Name, runId, err)
+		}
+	}()
+}
+
+// 等待执行表为空，执行结果都已经交给LogSink，超过deadline返回false
+func (scheduler *Scheduler) WaitIdle(deadline time.Time) bool {
+	for {
+		reply := make(chan int, 1)
+		scheduler.countChan <- reply
+		if <-reply == 0 {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(common.WORKER_DRAIN_CHECK_INTERVAL)
+	}
+}
 
-	// 执行任务
-	log.Infof("do job：%v", jobExecuteInfo.Job.Name)
-	G_executor.ExecuteJob(jobExecuteInfo)
+// 任务在本worker上的执行数(包括等待锁的)
+func (scheduler *Scheduler) countExecuting(jobName string) (count int) {
+	for _, jobExecuteInfo := range scheduler.jobExecuingTable {
+		if jobExecuteInfo.Job.Name == jobName {
+			count++
+		}
+	}
+	return
 }
 
 // 回传任务执行结果
@@ -146,21 +504,47 @@ func (scheduler *Scheduler) PushJobResult(jobResult *common.JobExecuteResult) {
 
 // 处理任务结果
 func (scheduler *Scheduler) handleJobResult(result *common.JobExecuteResult) {
-	// 删除执行状态
-	delete(scheduler.jobExecuingTable, result.ExecuteInfo.Job.Name)
+	// 删除执行状态，重试中的任务仍然保留
+	if !result.IsRetrying {
+		delete(scheduler.jobExecuingTable, result.ExecuteInfo.RunId)
+	}
 
 	// 存储执行结果
 	log.Infof("job execute success, output：%v, err: %v", string(result.Output), result.Err)
 
-	if result.Err != common.ERR_LOCK_ALREADY_REQUIRED {
+	// 任务空闲后继续补执行错过的调度
+	if jobPlan, ok := scheduler.jobPlanTable[result.ExecuteInfo.Job.Name]; ok && !result.IsRetrying {
+		scheduler.tryStartMisfire(jobPlan)
+	}
+
+	// 没有真正执行命令的结果，不记录日志
+	if !isNotExecuted(result.Err) {
 		jobLog := &common.JobLog{
 			JobName:      result.ExecuteInfo.Job.Name,
-			Command:      result.ExecuteInfo.Job.Command,
+			Command:      result.ExecuteInfo.Job.GetCommandLine(),
 			Output:       string(result.Output),
+			Stdout:       string(result.Stdout),
+			Stderr:       string(result.Stderr),
+			ExitCode:     result.ExitCode,
+			Signal:       result.Signal,
+			Worker:       G_register.localIp,
+			OutputSize:   result.OutputSize,
+			Truncated:    result.IsTruncated,
+			Spilled:      result.IsSpilled,
+			PeakMemory:   result.PeakMemory,
+			CpuTime:      result.CpuTime.Nanoseconds() / 1e6,
 			PlanTime:     result.ExecuteInfo.PlanTime.UnixNano() / 1e6,
 			ScheduleTime: result.ExecuteInfo.RealTime.UnixNano() / 1e6,
 			StartTime:    result.StartTime.UnixNano() / 1e6,
 			EndTime:      result.EndTime.UnixNano() / 1e6,
+			Duration:     result.EndTime.Sub(result.StartTime).Nanoseconds() / 1e6,
+			RunId:        result.RunId,
+			ParentRunId:  result.ParentRunId,
+			Attempt:      result.Attempt,
+			ShardIndex:   result.ExecuteInfo.ShardIndex,
+			ShardTotal:   result.ExecuteInfo.ShardTotal,
+			Misfire:      result.ExecuteInfo.IsMisfire,
+			Trigger:      result.ExecuteInfo.GetTriggerType(),
 		}
 
 		if result.Err != nil {
@@ -169,7 +553,54 @@ func (scheduler *Scheduler) handleJobResult(result *common.JobExecuteResult) {
 			jobLog.Err = ""
 		}
 
+		// 执行结果
+		switch {
+		case result.Err == common.ERR_JOB_KILLED:
+			jobLog.Status = common.JOB_STATUS_KILLED
+		case result.Err == common.ERR_JOB_REPLACED:
+			jobLog.Status = common.JOB_STATUS_REPLACED
+		case result.IsTimeout:
+			jobLog.Status = common.JOB_STATUS_TIMEOUT
+		case result.Err != nil:
+			jobLog.Status = common.JOB_STATUS_FAILED
+		default:
+			jobLog.Status = common.JOB_STATUS_SUCCESS
+		}
+
+		// 工作流节点记录所属的工作流
+		if trigger := result.ExecuteInfo.Trigger; trigger != nil {
+			jobLog.WorkflowName = trigger.WorkflowName
+			jobLog.WorkflowRun = trigger.WorkflowRunId
+		}
+
 		// TODO: 存储到MongoDB
 		G_logsink.Append(jobLog)
 	}
+
+	// 工作流节点执行结束，推进下游节点，重试等待中被强杀也算失败
+	trigger := result.ExecuteInfo.Trigger
+	if trigger != nil && trigger.WorkflowRunId != "" && !result.IsRetrying &&
+		(result.Err == common.ERR_JOB_RETRY_CANCELED || result.Err == common.ERR_JOB_QUEUE_CANCELED || !isNotExecuted(result.Err)) {
+		status := common.WORKFLOW_STATUS_SUCCESS
+		if result.Err != nil {
+			status = common.WORKFLOW_STATUS_FAILED
+		}
+
+		go func() {
+			if err := G_workflowMgr.FinishWorkflowNode(trigger.WorkflowName, trigger.WorkflowRunId, result.ExecuteInfo.Job.Name, status); err != nil {
+				log.Errorf("finish workflow %v run %v node %v err: %v", trigger.WorkflowName, trigger.WorkflowRunId, result.ExecuteInfo.Job.Name, err)
+			}
+		}()
+	}
+}
+
+// 抢锁失败、达到并发上限、重试或排队等待中被取消、触发或调度已被认领、补执行已被其他worker完成，都没有真正执行命令
+func isNotExecuted(err error) bool {
+	return err == common.ERR_LOCK_ALREADY_REQUIRED ||
+		err == common.ERR_NO_FREE_SLOT ||
+		err == common.ERR_JOB_RETRY_CANCELED ||
+		err == common.ERR_JOB_QUEUE_CANCELED ||
+		err == common.ERR_TRIGGER_ALREADY_CLAIMED ||
+		err == common.ERR_FIRE_ALREADY_DONE ||
+		err == common.ERR_FIRE_ALREADY_CLAIMED
 }
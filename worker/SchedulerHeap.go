@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"container/heap"
+	"github.com/MrDragon1122/crontab/common"
+)
+
+// 任务调度计划的小顶堆，堆顶是最近要到期的任务
+type jobPlanHeap []*common.JobSchedulerPlan
+
+func (h jobPlanHeap) Len() int { return len(h) }
+
+func (h jobPlanHeap) Less(i, j int) bool { return h[i].NextTime.Before(h[j].NextTime) }
+
+func (h jobPlanHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].Index = i
+	h[j].Index = j
+}
+
+func (h *jobPlanHeap) Push(x interface{}) {
+	jobPlan := x.(*common.JobSchedulerPlan)
+	jobPlan.Index = len(*h)
+	*h = append(*h, jobPlan)
+}
+
+func (h *jobPlanHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	jobPlan := old[n-1]
+	old[n-1] = nil
+	jobPlan.Index = -1
+	*h = old[:n-1]
+	return jobPlan
+}
+
+// 加入或替换任务计划
+func (h *jobPlanHeap) Put(oldPlan *common.JobSchedulerPlan, newPlan *common.JobSchedulerPlan) {
+	if oldPlan != nil && oldPlan.Index >= 0 {
+		newPlan.Index = oldPlan.Index
+		(*h)[newPlan.Index] = newPlan
+		oldPlan.Index = -1
+		heap.Fix(h, newPlan.Index)
+		return
+	}
+	heap.Push(h, newPlan)
+}
+
+// 移除任务计划
+func (h *jobPlanHeap) Remove(jobPlan *common.JobSchedulerPlan) {
+	if jobPlan.Index >= 0 {
+		heap.Remove(h, jobPlan.Index)
+	}
+}
+
+// 最近要到期的任务计划
+func (h jobPlanHeap) Top() *common.JobSchedulerPlan {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[0]
+}
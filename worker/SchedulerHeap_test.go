@@ -0,0 +1,94 @@
+package worker
+
+import (
+	"container/heap"
+	"github.com/MrDragon1122/crontab/common"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 检查小顶堆性质和每个计划记录的下标
+func checkJobPlanHeap(t *testing.T, h jobPlanHeap) {
+	t.Helper()
+	for i, jobPlan := range h {
+		if jobPlan.Index != i {
+			t.Fatalf("plan %v index = %v, want %v", jobPlan.Job.Name, jobPlan.Index, i)
+		}
+		if parent := (i - 1) / 2; i > 0 && h.Less(i, parent) {
+			t.Fatalf("plan %v at %v is earlier than its parent at %v", jobPlan.Job.Name, i, parent)
+		}
+	}
+}
+
+func newTestJobPlan(name string, nextTime time.Time) *common.JobSchedulerPlan {
+	return &common.JobSchedulerPlan{Job: &common.Job{Name: name}, NextTime: nextTime, Index: -1}
+}
+
+func TestJobPlanHeapInvariant(t *testing.T) {
+	var (
+		h     jobPlanHeap
+		plans = make(map[int]*common.JobSchedulerPlan)
+		rnd   = rand.New(rand.NewSource(1))
+		base  = time.Now()
+	)
+
+	randTime := func() time.Time {
+		return base.Add(time.Duration(rnd.Intn(1000)) * time.Second)
+	}
+
+	for i := 0; i < 5000; i++ {
+		id := rnd.Intn(200)
+		oldPlan := plans[id]
+
+		switch op := rnd.Intn(4); {
+		case op == 0 || oldPlan == nil: // 加入或替换
+			newPlan := newTestJobPlan("job"+strconv.Itoa(id), randTime())
+			h.Put(oldPlan, newPlan)
+			plans[id] = newPlan
+			if oldPlan != nil && oldPlan.Index != -1 {
+				t.Fatalf("replaced plan index = %v, want -1", oldPlan.Index)
+			}
+		case op == 1: // 移除
+			h.Remove(oldPlan)
+			if oldPlan.Index != -1 {
+				t.Fatalf("removed plan index = %v, want -1", oldPlan.Index)
+			}
+			delete(plans, id)
+		default: // 修改下次调度时间
+			oldPlan.NextTime = randTime()
+			heap.Fix(&h, oldPlan.Index)
+		}
+
+		checkJobPlanHeap(t, h)
+		if len(h) != len(plans) {
+			t.Fatalf("heap size = %v, want %v", len(h), len(plans))
+		}
+	}
+
+	// 依次弹出的计划按时间有序
+	var last time.Time
+	for h.Len() != 0 {
+		jobPlan := heap.Pop(&h).(*common.JobSchedulerPlan)
+		if jobPlan.NextTime.Before(last) {
+			t.Fatalf("popped %v before %v", jobPlan.NextTime, last)
+		}
+		last = jobPlan.NextTime
+	}
+}
+
+func TestJobPlanHeapRemoveTwice(t *testing.T) {
+	var h jobPlanHeap
+	jobPlan := newTestJobPlan("job1", time.Now())
+	h.Put(nil, jobPlan)
+	h.Put(nil, newTestJobPlan("job2", time.Now().Add(time.Second)))
+
+	h.Remove(jobPlan)
+	h.Remove(jobPlan)
+
+	if h.Len() != 1 || h.Top().Job.Name != "job2" {
+		t.Fatalf("heap after removing twice = %v plans, top %v", h.Len(), h.Top().Job.Name)
+	}
+	checkJobPlanHeap(t, h)
+}
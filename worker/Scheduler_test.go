@@ -0,0 +1,208 @@
+package worker
+
+import (
+	"container/heap"
+	"github.com/MrDragon1122/crontab/common"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 每次调度到期的任务数
+const benchDuePlans = 100
+
+// 构建包含n个任务计划的调度器，leader模式下非leader的worker不执行任务，只测量调度本身
+func newBenchScheduler(b *testing.B, n int) *Scheduler {
+	G_config = &Config{DispatchMode: common.DISPATCH_MODE_LEADER, MisfireThreshold: 60}
+	G_dispatcher = &Dispatcher{}
+
+	scheduler := &Scheduler{
+		jobPlanTable:      make(map[string]*common.JobSchedulerPlan, n),
+		workflowPlanTable: make(map[string]*common.JobSchedulerPlan),
+		jobExecuingTable:  make(map[string]*common.JobExecuteInfo),
+	}
+
+	for i := 0; i < n; i++ {
+		jobPlan, err := common.BuildJobSchedulerPlan(&common.Job{Name: "job" + strconv.Itoa(i), CronExpr: "0 0 1 1 *"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		scheduler.putJobPlan(scheduler.jobPlanTable, jobPlan)
+	}
+
+	return scheduler
+}
+
+func benchmarkTrySchedule(b *testing.B, n int) {
+	scheduler := newBenchScheduler(b, n)
+	plans := make([]*common.JobSchedulerPlan, 0, n)
+	for _, jobPlan := range scheduler.jobPlanTable {
+		plans = append(plans, jobPlan)
+	}
+	rnd := rand.New(rand.NewSource(1))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// 随机一批任务到期
+		b.StopTimer()
+		due := time.Now().Add(-10 * time.Millisecond)
+		for j := 0; j < benchDuePlans; j++ {
+			jobPlan := plans[rnd.Intn(n)]
+			jobPlan.NextTime = due
+			heap.Fix(&scheduler.jobPlanHeap, jobPlan.Index)
+		}
+		b.StartTimer()
+
+		scheduler.TrySchedule()
+	}
+}
+
+func BenchmarkTrySchedule10k(b *testing.B) {
+	benchmarkTrySchedule(b, 10000)
+}
+
+func BenchmarkTrySchedule100k(b *testing.B) {
+	benchmarkTrySchedule(b, 100000)
+}
+
+// 构建本worker为leader的调度器，分派的执行留在assignChan中
+func newLeaderScheduler() *Scheduler {
+	G_config = &Config{DispatchMode: common.DISPATCH_MODE_LEADER, MisfireThreshold: 60}
+	G_dispatcher = &Dispatcher{isLeader: 1, assignChan: make(chan *common.JobAssignment, 100)}
+	G_register = &Register{localIp: "10.0.0.1"}
+
+	return &Scheduler{
+		jobPlanTable:      make(map[string]*common.JobSchedulerPlan),
+		workflowPlanTable: make(map[string]*common.JobSchedulerPlan),
+		jobExecuingTable:  make(map[string]*common.JobExecuteInfo),
+	}
+}
+
+func TestLeaderMisfireWaitsForWatermark(t *testing.T) {
+	scheduler := newLeaderScheduler()
+	job := &common.Job{Name: "job", CronExpr: "* * * * *", Timezone: "UTC", MisfirePolicy: common.MISFIRE_POLICY_RUN_ALL, MisfireMaxRuns: 3}
+	jobPlan, err := common.BuildJobSchedulerPlan(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.putJobPlan(scheduler.jobPlanTable, jobPlan)
+
+	now := time.Now()
+	jobPlan.NextTime = now.Add(-10 * time.Minute)
+	scheduler.handleMisfire(jobPlan, now)
+
+	// 一次只分派一个补执行
+	nextAssignment := func() *common.JobAssignment {
+		select {
+		case assignment := <-G_dispatcher.assignChan:
+			if !assignment.IsMisfire {
+				t.Fatalf("assignment %+v is not a misfire", assignment)
+			}
+			return assignment
+		default:
+			return nil
+		}
+	}
+	first := nextAssignment()
+	if first == nil || nextAssignment() != nil {
+		t.Fatal("handleMisfire should dispatch exactly one misfire")
+	}
+	planTime := time.Unix(0, first.PlanTime*1e6)
+
+	// leader上没有执行记录，重复检查不会继续分派
+	scheduler.tryStartMisfire(jobPlan)
+	if nextAssignment() != nil {
+		t.Fatal("dispatched the next misfire before the previous one finished")
+	}
+
+	// 水位线推进到更早的时间不算结束
+	scheduler.handleWatermark("job", "job", planTime.Add(-time.Minute))
+	if nextAssignment() != nil {
+		t.Fatal("dispatched the next misfire on an older watermark")
+	}
+
+	scheduler.handleWatermark("job", "job", planTime)
+	second := nextAssignment()
+	if second == nil || second.PlanTime <= first.PlanTime {
+		t.Fatalf("second misfire = %+v after watermark reached %v", second, planTime)
+	}
+
+	// 水位线一直不推进时，超时后继续
+	jobPlan.MisfireWait.Deadline = time.Now().Add(-time.Second)
+	scheduler.tryStartMisfire(jobPlan)
+	if third := nextAssignment(); third == nil || third.PlanTime <= second.PlanTime {
+		t.Fatalf("third misfire = %+v after wait deadline", third)
+	}
+	if len(jobPlan.Misfires) != 0 {
+		t.Errorf("misfires left = %v", jobPlan.Misfires)
+	}
+}
+
+func TestLeaderMisfireWaitsForAllShards(t *testing.T) {
+	scheduler := newLeaderScheduler()
+	job := &common.Job{Name: "job", CronExpr: "* * * * *", Timezone: "UTC", Shards: 2, MisfirePolicy: common.MISFIRE_POLICY_RUN_ALL}
+	jobPlan, err := common.BuildJobSchedulerPlan(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.putJobPlan(scheduler.jobPlanTable, jobPlan)
+
+	now := time.Now()
+	jobPlan.NextTime = now.Add(-5 * time.Minute)
+	scheduler.handleMisfire(jobPlan, now)
+	if len(G_dispatcher.assignChan) != 2 {
+		t.Fatalf("dispatched %v assignments, want one per shard", len(G_dispatcher.assignChan))
+	}
+	planTime := jobPlan.MisfireWait.PlanTime
+
+	scheduler.handleWatermark("job", common.BuildShardName("job", 0), planTime)
+	if len(G_dispatcher.assignChan) != 2 {
+		t.Fatal("dispatched the next misfire before every shard finished")
+	}
+	scheduler.handleWatermark("job", common.BuildShardName("job", 1), planTime)
+	if len(G_dispatcher.assignChan) != 4 {
+		t.Fatalf("dispatched %v assignments after every shard finished, want 4", len(G_dispatcher.assignChan))
+	}
+}
+
+func TestCatchUpFromWatermarks(t *testing.T) {
+	scheduler := newLeaderScheduler()
+
+	jobs := []*common.Job{
+		{Name: "job", CronExpr: "*/5 * * * *", Timezone: "UTC"},
+		{Name: "broadcast", CronExpr: "*/5 * * * *", Timezone: "UTC", ExecutionMode: common.EXECUTION_MODE_BROADCAST},
+		{Name: "sharded", CronExpr: "*/5 * * * *", Timezone: "UTC", Shards: 2},
+		{Name: "new", CronExpr: "*/5 * * * *", Timezone: "UTC"},
+	}
+	for _, job := range jobs {
+		jobPlan, err := common.BuildJobSchedulerPlan(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scheduler.putJobPlan(scheduler.jobPlanTable, jobPlan)
+	}
+	nextTime := scheduler.jobPlanTable["job"].NextTime
+
+	// 选举期间错过了两次调度，分片任务有一个分片没有水位线
+	watermark := nextTime.Add(-15 * time.Minute)
+	scheduler.catchUpFromWatermarks(map[string]time.Time{
+		"job":                               watermark,
+		"broadcast":                         watermark,
+		common.BuildShardName("sharded", 0): watermark,
+	})
+
+	if got := scheduler.jobPlanTable["job"].NextTime; !got.Equal(watermark.Add(5 * time.Minute)) {
+		t.Errorf("job NextTime = %v, want %v", got, watermark.Add(5*time.Minute))
+	}
+	if scheduler.jobPlanHeap.Top().Job.Name != "job" {
+		t.Errorf("heap top = %v, want job", scheduler.jobPlanHeap.Top().Job.Name)
+	}
+	for _, name := range []string{"broadcast", "sharded", "new"} {
+		if got := scheduler.jobPlanTable[name].NextTime; !got.Equal(nextTime) {
+			t.Errorf("%v NextTime = %v, want unchanged %v", name, got, nextTime)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package worker
+
+import (
+	"encoding/json"
+	"github.com/MrDragon1122/crontab/common"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+	"time"
+	"traefik/log"
+)
+
+// 工作流管理，调度工作流并在节点结束后推进下游
+type WorkflowMgr struct {
+	client  *clientv3.Client
+	kv      clientv3.KV
+	lease   clientv3.Lease
+	watcher clientv3.Watcher
+}
+
+// 定义单例
+var G_workflowMgr *WorkflowMgr
+
+// 初始化
+func InitWorkflowMgr() (err error) {
+	// 初始化etcd配置
+	config := clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,                                     // etcd集群地址
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 超时
+	}
+
+	// 建立etcd的连接
+	client, err := clientv3.New(config)
+	if err != nil {
+		return
+	}
+
+	G_workflowMgr = &WorkflowMgr{
+		client:  client,
+		kv:      clientv3.NewKV(client),
+		lease:   clientv3.NewLease(client),
+		watcher: clientv3.NewWatcher(client),
+	}
+
+	// 启动监听工作流
+	log.Info("start worker workflow watch")
+	err = G_workflowMgr.WatchWorkflows()
+
+	return
+}
+
+// 监听工作流的变化，有cron表达式的工作流进入调度计划
+func (workflowMgr *WorkflowMgr) WatchWorkflows() (err error) {
+	getResponse, err := workflowMgr.kv.Get(context.Background(), common.WORKFLOW_SAVE_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	for _, val := range getResponse.Kvs {
+		if workflow, err := common.UnpackWorkflow(val.Value); err == nil {
+			jobEvent := &common.JobEvent{EventType: common.JOB_EVENT_WORKFLOW_SAVE, Workflow: workflow}
+			G_scheduler.PushJobEvent(jobEvent)
+		}
+	}
+
+	go func() {
+		// 从get时刻的后续版本开始监听变化
+		watchStartRevison := getResponse.Header.Revision + 1
+		WatchChan := workflowMgr.watcher.Watch(context.Background(), common.WORKFLOW_SAVE_DIR, clientv3.WithRev(watchStartRevison), clientv3.WithPrefix())
+
+		var jobEvent *common.JobEvent
+		for watchResp := range WatchChan {
+			for _, watchEvent := range watchResp.Events {
+				switch watchEvent.Type {
+				case mvccpb.PUT: // 工作流保存事件
+					workflow, err := common.UnpackWorkflow(watchEvent.Kv.Value)
+					if err != nil {
+						log.Errorf("watch func unpack workflow err: %v", err)
+						continue
+					}
+					jobEvent = &common.JobEvent{EventType: common.JOB_EVENT_WORKFLOW_SAVE, Workflow: workflow}
+				case mvccpb.DELETE: // 工作流删除事件
+					workflowName := common.ExtractWorkflowName(string(watchEvent.Kv.Key))
+					jobEvent = &common.JobEvent{EventType: common.JOB_EVENT_WORKFLOW_DELETE, Workflow: &common.Workflow{Name: workflowName}}
+				}
+
+				// 推送给scheduler
+				G_scheduler.PushJobEvent(jobEvent)
+			}
+		}
+	}()
+
+	return
+}
+
+// 启动工作流的一次运行，多个worker用同一个runId启动时只有一个成功
+func (workflowMgr *WorkflowMgr) StartWorkflowRun(workflow *common.Workflow, runId string) (err error) {
+	run := common.BuildWorkflowRun(workflow, runId)
+	triggers, err := workflowMgr.startReadyNodes(run)
+	if err != nil {
+		return
+	}
+
+	value, err := json.Marshal(run)
+	if err != nil {
+		return
+	}
+
+	// 运行记录保留一段时间后自动删除
+	leaseResp, err := workflowMgr.lease.Grant(context.Background(), common.WORKFLOW_RUN_TTL)
+	if err != nil {
+		return
+	}
+
+	runKey := common.BuildWorkflowRunKey(workflow.Name, runId)
+	txnResp, err := workflowMgr.kv.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(runKey), "=", 0)).
+		Then(clientv3.OpPut(runKey, string(value), clientv3.WithLease(leaseResp.ID))).
+		Commit()
+	if err != nil {
+		return
+	}
+
+	// 已经被其他worker启动
+	if !txnResp.Succeeded {
+		workflowMgr.lease.Revoke(context.Background(), leaseResp.ID)
+		return common.ERR_WORKFLOW_RUN_EXISTS
+	}
+
+	log.Infof("workflow %v run %v started", workflow.Name, runId)
+
+	// 运行记录已保存，触发失败的节点由master按失败处理
+	return workflowMgr.triggerNodes(triggers)
+}
+
+// 节点执行结束，更新运行记录并触发满足条件的下游节点
+func (workflowMgr *WorkflowMgr) FinishWorkflowNode(workflowName string, runId string, jobName string, status string) (err error) {
+	runKey := common.BuildWorkflowRunKey(workflowName, runId)
+
+	// 多个节点可能同时结束，按版本号比较更新，冲突时重试
+	for i := 0; i < common.WORKFLOW_UPDATE_RETRY; i++ {
+		getResp, err := workflowMgr.kv.Get(context.Background(), runKey)
+		if err != nil {
+			return err
+		}
+		if len(getResp.Kvs) == 0 {
+			return common.ERR_WORKFLOW_NOT_FOUND
+		}
+
+		run, err := common.UnpackWorkflowRun(getResp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+
+		// 节点已经结束(master按失败处理或者广播节点其他worker先结束)，重复的结果忽略
+		if nodeRun, ok := run.Nodes[jobName]; !ok || nodeRun.Status != common.WORKFLOW_STATUS_RUNNING {
+			return nil
+		}
+
+		run.FinishNode(jobName, status)
+		triggers, err := workflowMgr.startReadyNodes(run)
+		if err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+
+		txnResp, err := workflowMgr.kv.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.ModRevision(runKey), "=", getResp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(runKey, string(value), clientv3.WithIgnoreLease())).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txnResp.Succeeded {
+			continue
+		}
+
+		if run.Status != common.WORKFLOW_STATUS_RUNNING {
+			log.Infof("workflow %v run %v finished: %v", workflowName, runId, run.Status)
+		}
+		return workflowMgr.triggerNodes(triggers)
+	}
+
+	return common.ERR_JOB_CONFLICT
+}
+
+// 推进工作流并标记可以启动的节点，任务已经不存在的节点直接失败
+func (workflowMgr *WorkflowMgr) startReadyNodes(run *common.WorkflowRun) (triggers []*common.JobTrigger, err error) {
+	for {
+		ready := run.Advance()
+		if len(ready) == 0 {
+			return
+		}
+
+		failed := false
+		for _, jobName := range ready {
+			job, err := workflowMgr.getJob(jobName)
+			if err != nil && err != common.ERR_JOB_NOT_FOUND {
+				return nil, err
+			}
+
+			run.StartNode(jobName, common.BuildRunId())
+			if err == common.ERR_JOB_NOT_FOUND {
+				run.FinishNode(jobName, common.WORKFLOW_STATUS_FAILED)
+				failed = true
+				continue
+			}
+			triggers = append(triggers, run.BuildNodeTrigger(jobName, job))
+		}
+
+		// 失败的节点会影响下游，重新推进
+		if !failed {
+			return
+		}
+	}
+}
+
+// 读取节点的任务定义
+func (workflowMgr *WorkflowMgr) getJob(jobName string) (job *common.Job, err error) {
+	getResp, err := workflowMgr.kv.Get(context.Background(), common.JOB_SAVE_DIR+jobName)
+	if err != nil {
+		return
+	}
+	if len(getResp.Kvs) == 0 {
+		err = common.ERR_JOB_NOT_FOUND
+		return
+	}
+	return common.Unpack(getResp.Kvs[0].Value)
+}
+
+// 通过手动触发的方式启动节点，同时写入pending状态，广播任务写入broadcast状态
+func (workflowMgr *WorkflowMgr) triggerNodes(triggers []*common.JobTrigger) (err error) {
+	if len(triggers) == 0 {
+		return
+	}
+
+	// 与手动触发一致，未被认领的请求过期自动删除
+	leaseResp, err := workflowMgr.lease.Grant(context.Background(), common.JOB_TRIGGER_TTL)
+	if err != nil {
+		return
+	}
+	statusLeaseResp, err := workflowMgr.lease.Grant(context.Background(), common.JOB_TRIGGER_STATUS_TTL)
+	if err != nil {
+		return
+	}
+
+	for _, trigger := range triggers {
+		initStatus := common.TRIGGER_STATUS_PENDING
+		if trigger.Job.IsBroadcast() {
+			initStatus = common.TRIGGER_STATUS_BROADCAST
+		}
+
+		triggerValue, err := json.Marshal(trigger)
+		if err != nil {
+			return err
+		}
+		statusValue, err := json.Marshal(&common.JobTriggerStatus{
+			TriggerId:  trigger.TriggerId,
+			JobName:    trigger.Job.Name,
+			Status:     initStatus,
+			UpdateTime: trigger.TriggerTime,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err = workflowMgr.kv.Txn(context.Background()).Then(
+			clientv3.OpPut(common.BuildTriggerKey(trigger), string(triggerValue), clientv3.WithLease(leaseResp.ID)),
+			clientv3.OpPut(common.BuildTriggerStatusKey(trigger.TriggerId), string(statusValue), clientv3.WithLease(statusLeaseResp.ID)),
+		).Commit(); err != nil {
+			return err
+		}
+	}
+	return
+}
@@ -4,6 +4,10 @@ import (
 	"flag"
 	"github.com/MrDragon1122/crontab/worker"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	_ "time/tzdata" // 内置时区数据，master和worker解析时区的结果一致
 	"traefik/log"
 )
 
@@ -28,6 +32,13 @@ func main() {
 	}
 	log.Info("init config success")
 
+	// 启动执行器，注册信息中上报正在执行的任务数
+	if err := worker.InitExecutor(); err != nil {
+		log.Errorf("init executor err: %v", err)
+		os.Exit(4)
+	}
+	log.Info("init executor success")
+
 	// 启动worker注册
 	if err := worker.InitRegister(); err != nil {
 		log.Errorf("init worker register err: %v", err)
@@ -35,6 +46,13 @@ func main() {
 	}
 	log.Info("init worker register success")
 
+	// 启动分派器，leader分派模式下参与选举
+	if err := worker.InitDispatcher(); err != nil {
+		log.Errorf("init dispatcher err: %v", err)
+		os.Exit(7)
+	}
+	log.Info("init dispatcher success")
+
 	// 启动日志存储
 	if err := worker.InitLogSink(); err != nil {
 		log.Errorf("init log sink err: %v", err)
@@ -42,13 +60,6 @@ func main() {
 	}
 	log.Info("init log sink success")
 
-	// 启动执行器
-	if err := worker.InitExecutor(); err != nil {
-		log.Errorf("init executor err: %v", err)
-		os.Exit(4)
-	}
-	log.Info("init executor success")
-
 	// 启动调度进程
 	worker.InitScheduler()
 	log.Infof("init scheduler success")
@@ -60,6 +71,35 @@ func main() {
 	}
 	log.Info("init job mgr success")
 
-	// 阻塞
-	select {}
+	// 任务加载后再参与leader选举
+	worker.StartDispatcher()
+
+	// 初始化workflow mgr
+	if err := worker.InitWorkflowMgr(); err != nil {
+		log.Errorf("init workflow mgr err: %v", err)
+		os.Exit(6)
+	}
+	log.Info("init workflow mgr success")
+
+	// 收到SIGTERM、SIGINT或master的下线请求后优雅退出
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+
+	var timeout time.Duration
+	select {
+	case sig := <-sigChan:
+		log.Infof("receive signal %v, start draining", sig)
+	case timeout = <-worker.DrainRequested():
+		log.Info("receive drain request from master, start draining")
+	}
+
+	// 下线过程中再次收到信号，立即退出
+	go func() {
+		sig := <-sigChan
+		log.Warnf("receive signal %v again, exit immediately", sig)
+		os.Exit(1)
+	}()
+
+	worker.Drain(timeout)
+	log.Info("worker exit")
 }